@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Operations on core recorded in audit log
+const (
+	AddUser       = "AddUser"
+	DelUser       = "DelUser"
+	AddInbound    = "AddInbound"
+	RemoveInbound = "RemoveInbound"
+)
+
+// Reasons of a change
+const (
+	ReasonNewService     = "new service"
+	ReasonServiceRemoved = "service removed" // no longer listed by backend, e.g. deleted
+	ReasonExpired        = "expired"         // past its expire_at, listed by backend or not
+	ReasonQuotaExceeded  = "quota exceeded"
+	ReasonDriftRepair    = "drift repair" // core lost its state and everything is applied again
+	ReasonNodeSettings   = "node settings changed"
+	ReasonStartup        = "startup"
+	ReasonAdminPrefix    = "admin " // followed by action, e.g. admin kick
+)
+
+// Results of a change
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// defaultQueryLimit is how many entries Query return if limit is not set
+const defaultQueryLimit = 100
+
+// Entry is a change made to core
+type Entry struct {
+	Time      time.Time `json:"time"`
+	NodeID    uint64    `json:"node_id"`
+	Operation string    `json:"operation"`
+	Tag       string    `json:"tag"`
+	Email     string    `json:"email,omitempty"` // empty for node inbounds
+	Reason    string    `json:"reason"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Revision  string    `json:"revision,omitempty"` // backend revision changes were computed from
+	CycleID   string    `json:"cycle_id,omitempty"`
+}
+
+// Query select entries, empty fields match everything
+type Query struct {
+	Email     string
+	Operation string
+	Reason    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int // newest entries kept, default 100
+}
+
+// Logger append entries to a JSONL file, rotated by size and age
+// rotated files are kept next to it and still searched by Query
+type Logger struct {
+	Path   string
+	writer *lumberjack.Logger
+	lock   sync.Mutex
+}
+
+// NewLogger return a logger writing to path
+// maxSize is in megabytes, maxAge in days, 0 keeps rotated files forever
+func NewLogger(path string, maxSize int, maxAge int) (*Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("Error Creating Audit Log Directory: %w", err)
+	}
+	return &Logger{
+		Path: path,
+		writer: &lumberjack.Logger{
+			Filename:  path,
+			MaxSize:   maxSize,
+			MaxAge:    maxAge,
+			LocalTime: true,
+		},
+	}, nil
+}
+
+// Record append e to log
+// an entry is one write, so a crash never leaves half a line behind another entry
+func (l *Logger) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Close close current file
+func (l *Logger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.writer.Close()
+}
+
+// Query return entries matching q, oldest first
+// rotated files are searched as well as current one
+func (l *Logger) Query(q Query) ([]Entry, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultQueryLimit
+	}
+	entries := make([]Entry, 0)
+	for _, path := range l.files() {
+		if err := scan(path, func(e *Entry) {
+			if q.match(e) {
+				entries = append(entries, *e)
+				if len(entries) > q.Limit {
+					entries = entries[1:]
+				}
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// files return rotated files oldest first, then current file
+// lumberjack names rotated files name-<timestamp>.ext, which sorts by time
+func (l *Logger) files() []string {
+	ext := filepath.Ext(l.Path)
+	prefix := strings.TrimSuffix(l.Path, ext) + "-"
+	rotated, _ := filepath.Glob(prefix + "*" + ext)
+	sort.Strings(rotated)
+	return append(rotated, l.Path)
+}
+
+// scan call each for every entry in file at path, lines that are not entries are skipped
+func scan(path string, each func(e *Entry)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		each(&e)
+	}
+	return scanner.Err()
+}
+
+func (q *Query) match(e *Entry) bool {
+	return (q.Email == "" || e.Email == q.Email) &&
+		(q.Operation == "" || e.Operation == q.Operation) &&
+		(q.Reason == "" || e.Reason == q.Reason) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
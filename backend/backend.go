@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// Backend is the control plane a node gets its settings from and reports traffic to
+// Every implementation is bound to a single node
+type Backend interface {
+	// GetNode return settings of the node
+	GetNode(ctx context.Context) (*models.Node, error)
+	// ListUsers return every user allowed on the node
+	ListUsers(ctx context.Context) ([]models.User, error)
+	// ListServices return every service on the node
+	ListServices(ctx context.Context) ([]models.Service, error)
+	// ReportTraffic report traffic used since last report
+	ReportTraffic(ctx context.Context, traffic []models.Traffic) error
+}
+
+// PartialReportError is returned by ReportTraffic when backend took only part of traffic
+// Traffic is what it did not take, to be reported again later
+type PartialReportError struct {
+	Traffic []models.Traffic
+	Err     error
+}
+
+func (e *PartialReportError) Error() string {
+	return fmt.Sprintf("traffic of %d users not reported: %v", len(e.Traffic), e.Err)
+}
+
+func (e *PartialReportError) Unwrap() error {
+	return e.Err
+}
+
+// StatusReporter is implemented by backends that accept node heartbeats
+type StatusReporter interface {
+	ReportNodeStatus(ctx context.Context, status *models.NodeStatus) error
+}
+
+// Revisioner is implemented by backends that version their data
+// Revision is the version of services last listed, for audit
+type Revisioner interface {
+	Revision() string
+}
+
+// Notifier is implemented by backends that know when their data changed
+// so the node can sync immediately instead of waiting for next poll
+type Notifier interface {
+	Changed() <-chan struct{}
+}
@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// fileData is the content of a static backend file
+// keys follow the json names of models, in YAML or JSON
+type fileData struct {
+	Node     models.Node      `json:"node"`
+	Users    []models.User    `json:"users"`
+	Services []models.Service `json:"services"`
+}
+
+// FileBackend read node, users and services from a local YAML or JSON file
+// and write traffic to a local JSONL ledger, for standalone nodes and testing without a panel
+// CurrentTraffic in file is where accounting starts, traffic in ledger is added to it
+type FileBackend struct {
+	Path    string
+	Ledger  string
+	data    *fileData
+	used    map[string]uint64 // traffic in ledger by email
+	lock    sync.RWMutex
+	ledger  sync.Mutex
+	watcher *fsnotify.Watcher
+	changed chan struct{}
+}
+
+// NewFileBackend load path and start watching it
+func NewFileBackend(path string, ledger string) (*FileBackend, error) {
+	b := &FileBackend{
+		Path:    path,
+		Ledger:  ledger,
+		changed: make(chan struct{}, 1),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	used, err := readLedger(ledger)
+	if err != nil {
+		return nil, err
+	}
+	b.used = used
+
+	// Watch the directory, editors often replace files instead of writing in place
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	b.watcher = watcher
+	go b.watch()
+	return b, nil
+}
+
+// Close stop watching the file
+func (b *FileBackend) Close() error {
+	return b.watcher.Close()
+}
+
+// Changed implements Notifier
+func (b *FileBackend) Changed() <-chan struct{} {
+	return b.changed
+}
+
+// GetNode implements Backend
+func (b *FileBackend) GetNode(ctx context.Context) (*models.Node, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	node := b.data.Node
+	return &node, nil
+}
+
+// ListUsers implements Backend
+func (b *FileBackend) ListUsers(ctx context.Context) ([]models.User, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	users := append([]models.User(nil), b.data.Users...)
+	for i := range users {
+		users[i].CurrentTraffic += b.used[users[i].Email]
+	}
+	return users, nil
+}
+
+// ListServices implements Backend
+func (b *FileBackend) ListServices(ctx context.Context) ([]models.Service, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]models.Service(nil), b.data.Services...), nil
+}
+
+// ReportTraffic implements Backend
+// every report is appended to ledger as a json line and counted in CurrentTraffic of its user
+func (b *FileBackend) ReportTraffic(ctx context.Context, traffic []models.Traffic) error {
+	if b.Ledger == "" {
+		return nil
+	}
+	b.ledger.Lock()
+	defer b.ledger.Unlock()
+	f, err := os.OpenFile(b.Ledger, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// A line cut short by a crash must not swallow the next one
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+		}
+	}
+	enc := json.NewEncoder(f)
+	for i := range traffic {
+		if traffic[i].Time.IsZero() {
+			traffic[i].Time = time.Now()
+		}
+		if err := enc.Encode(&traffic[i]); err != nil {
+			return err
+		}
+		b.lock.Lock()
+		b.used[traffic[i].User.Email] += traffic[i].Uplink + traffic[i].Downlink
+		b.lock.Unlock()
+	}
+	return nil
+}
+
+// readLedger sum traffic in ledger by email, so accounting goes on across restarts
+// a line cut short by a crash is skipped, the rest of ledger still counts
+func readLedger(path string) (map[string]uint64, error) {
+	used := make(map[string]uint64)
+	if path == "" {
+		return used, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return used, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error Reading Ledger: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var t models.Traffic
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			utils.Log.WithError(err).Warn("Skipped Malformed Ledger Line")
+			continue
+		}
+		used[t.User.Email] += t.Uplink + t.Downlink
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error Reading Ledger: %w", err)
+	}
+	return used, nil
+}
+
+func (b *FileBackend) watch() {
+	for {
+		select {
+		case event, ok := <-b.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(b.Path) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := b.load(); err != nil {
+				utils.Log.WithError(err).Error("Error Reloading Backend File, Keeping Last Content")
+				continue
+			}
+			utils.Log.Info("Backend File Reloaded")
+			select {
+			case b.changed <- struct{}{}:
+			default:
+			}
+		case err, ok := <-b.watcher.Errors:
+			if !ok {
+				return
+			}
+			utils.Log.WithError(err).Error("Error Watching Backend File")
+		}
+	}
+}
+
+// load parse file and replace content only if it is valid
+func (b *FileBackend) load() error {
+	raw, err := ioutil.ReadFile(b.Path)
+	if err != nil {
+		return err
+	}
+
+	// YAML is converted to JSON so json tags of models apply to both
+	if ext := strings.ToLower(filepath.Ext(b.Path)); ext == ".yml" || ext == ".yaml" {
+		var v interface{}
+		if err := yaml.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("Error Parsing %s: %w", b.Path, err)
+		}
+		v, err = yamlToJSON(v)
+		if err != nil {
+			return fmt.Errorf("Error Parsing %s: %w", b.Path, err)
+		}
+		if raw, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	var data fileData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("Error Parsing %s: %w", b.Path, err)
+	}
+
+	b.lock.Lock()
+	b.data = &data
+	b.lock.Unlock()
+	return nil
+}
+
+// yamlToJSON turn map[interface{}]interface{} from yaml.v2 into map[string]interface{}
+func yamlToJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, errors.New("non string key in map")
+			}
+			converted, err := yamlToJSON(value)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i := range v {
+			converted, err := yamlToJSON(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+func TestFileBackendLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rayagent-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backend.json")
+	ledger := filepath.Join(dir, "ledger.jsonl")
+	users := `{"users": [
+		{"email": "a@example.com", "username": "a", "current_traffic": 100, "max_traffic": 1000},
+		{"email": "b@example.com", "username": "b", "max_traffic": 1000}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Last line was cut short by a crash
+	lines := `{"user":{"email":"a@example.com"},"uplink":10,"downlink":5}
+{"user":{"email":"a@example.com"},"uplink":1,"downlink":1}
+{"user":{"email":"b@exa`
+	if err := ioutil.WriteFile(ledger, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	current := func(b *FileBackend) map[string]uint64 {
+		list, err := b.ListUsers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]uint64)
+		for _, u := range list {
+			m[u.Email] = u.CurrentTraffic
+		}
+		return m
+	}
+	tests := []struct {
+		name    string
+		report  []models.Traffic
+		current map[string]uint64
+	}{
+		{"ledger is added on load", nil, map[string]uint64{"a@example.com": 117, "b@example.com": 0}},
+		{"reports are counted", []models.Traffic{{User: models.User{Email: "b@example.com"}, Uplink: 3, Downlink: 4}}, map[string]uint64{"a@example.com": 117, "b@example.com": 7}},
+		{"reports survive restart", nil, map[string]uint64{"a@example.com": 117, "b@example.com": 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A new backend every time, as after a restart
+			b, err := NewFileBackend(path, ledger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if tt.report != nil {
+				if err := b.ReportTraffic(context.Background(), tt.report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := current(b)
+			for email, want := range tt.current {
+				if got[email] != want {
+					t.Errorf("current traffic of %s = %d, want %d", email, got[email], want)
+				}
+			}
+		})
+	}
+}
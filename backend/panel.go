@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// panelClient is a minimal json client for panels authenticating with query parameters
+// as the SSPanel and V2Board node APIs do
+type panelClient struct {
+	URL        string
+	Query      url.Values // appended to every request, e.g. key and node_id
+	httpClient *http.Client
+}
+
+func newPanelClient(baseURL string, query url.Values) *panelClient {
+	return &panelClient{
+		URL:        baseURL,
+		Query:      query,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *panelClient) get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, out)
+}
+
+func (c *panelClient) post(ctx context.Context, path string, in interface{}, out interface{}) error {
+	return c.do(ctx, http.MethodPost, path, in, out)
+}
+
+func (c *panelClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("Error Marshalling Request: %w", err)
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path+"?"+c.Query.Encode(), body)
+	if err != nil {
+		return fmt.Errorf("Error Generating Request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error Calling Panel API %s %s: %w", method, path, err)
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	}()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Error Calling Panel API %s %s: Code %d", method, path, response.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("Error Parsing Panel API Response: %w", err)
+	}
+	return nil
+}
+
+// unknownUsers return traffic of users panel has no ID for as a partial report, nil if there is none
+func unknownUsers(traffic []models.Traffic) error {
+	if len(traffic) == 0 {
+		return nil
+	}
+	return &PartialReportError{Traffic: traffic, Err: errors.New("users not known to panel")}
+}
+
+// transportName map panel transport names onto the ones v2ray protobufs use
+func transportName(network string) string {
+	switch network {
+	case "", "tcp":
+		return "tcp"
+	case "ws":
+		return "websocket"
+	case "kcp":
+		return "mkcp"
+	case "h2":
+		return "http"
+	case "ds":
+		return "domainsocket"
+	default:
+		return network
+	}
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+func testTraffic(email string, up uint64) models.Traffic {
+	return models.Traffic{User: models.User{Email: email}, Uplink: up}
+}
+
+func TestReportTrafficUnknownUsers(t *testing.T) {
+	var posted []map[string]uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var data []map[string]uint64
+		var wrapped struct {
+			Data []map[string]uint64 `json:"data"`
+		}
+		if json.Unmarshal(body, &wrapped) == nil && wrapped.Data != nil {
+			data = wrapped.Data
+		} else {
+			json.Unmarshal(body, &data)
+		}
+		posted = append(posted, data...)
+		w.Write([]byte(`{"ret":1}`))
+	}))
+	defer server.Close()
+
+	ssPanel := NewSSPanelBackend(server.URL, "key", 1)
+	ssPanel.userIDs["a@example.com"] = 7
+	v2board := NewV2BoardBackend(server.URL, "token", 1, 10000)
+	v2board.userIDs["a@example.com"] = 7
+	backends := map[string]Backend{"sspanel": ssPanel, "v2board": v2board}
+
+	tests := []struct {
+		name    string
+		traffic []models.Traffic
+		posted  []uint64 // user IDs sent to panel
+		left    []string // emails handed back
+	}{
+		{"known users are reported", []models.Traffic{testTraffic("a@example.com", 1)}, []uint64{7}, nil},
+		{"unknown users are handed back", []models.Traffic{testTraffic("a@example.com", 1), testTraffic("b@example.com", 2)}, []uint64{7}, []string{"b@example.com"}},
+		{"nothing is sent if no user is known", []models.Traffic{testTraffic("b@example.com", 2)}, nil, []string{"b@example.com"}},
+	}
+	for name, b := range backends {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				posted = nil
+				err := b.ReportTraffic(context.Background(), tt.traffic)
+
+				var ids []uint64
+				for _, p := range posted {
+					ids = append(ids, p["user_id"])
+				}
+				if !reflect.DeepEqual(ids, tt.posted) {
+					t.Errorf("posted user IDs %v, want %v", ids, tt.posted)
+				}
+				var partial *PartialReportError
+				if tt.left == nil {
+					if err != nil {
+						t.Errorf("ReportTraffic() error = %v", err)
+					}
+					return
+				}
+				if !errors.As(err, &partial) {
+					t.Fatalf("ReportTraffic() error = %v, want partial report", err)
+				}
+				var left []string
+				for _, traffic := range partial.Traffic {
+					left = append(left, traffic.User.Email)
+				}
+				if !reflect.DeepEqual(left, tt.left) {
+					t.Errorf("handed back %v, want %v", left, tt.left)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/raydash"
+)
+
+// RayDashBackend talk to RayDash through its REST API
+type RayDashBackend struct {
+	NodeID uint64
+	client *raydash.Client
+}
+
+// NewRayDashBackend return a backend of node nodeID using client
+func NewRayDashBackend(client *raydash.Client, nodeID uint64) *RayDashBackend {
+	return &RayDashBackend{
+		NodeID: nodeID,
+		client: client,
+	}
+}
+
+// Client return the underlying RayDash client
+func (b *RayDashBackend) Client() *raydash.Client {
+	return b.client
+}
+
+// GetNode implements Backend
+func (b *RayDashBackend) GetNode(ctx context.Context) (*models.Node, error) {
+	return b.client.GetNode(ctx, b.NodeID)
+}
+
+// ListUsers implements Backend
+func (b *RayDashBackend) ListUsers(ctx context.Context) ([]models.User, error) {
+	return b.client.ListUsers(ctx, b.NodeID)
+}
+
+// ListServices implements Backend
+func (b *RayDashBackend) ListServices(ctx context.Context) ([]models.Service, error) {
+	return b.client.ListServices(ctx, b.NodeID)
+}
+
+// Revision implements Revisioner
+func (b *RayDashBackend) Revision() string {
+	return b.client.Revision()
+}
+
+// ReportTraffic implements Backend
+// RayDash keeps accumulated traffic on user, so the whole user is patched
+func (b *RayDashBackend) ReportTraffic(ctx context.Context, traffic []models.Traffic) error {
+	for i := range traffic {
+		if err := b.client.PatchUser(ctx, &traffic[i].User); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReportNodeStatus implements StatusReporter
+func (b *RayDashBackend) ReportNodeStatus(ctx context.Context, status *models.NodeStatus) error {
+	return b.client.ReportNodeStatus(ctx, b.NodeID, status)
+}
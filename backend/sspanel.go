@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// SSPanelBackend talk to panels exposing the SSPanel mod_mu web API
+type SSPanelBackend struct {
+	NodeID  uint64
+	client  *panelClient
+	userIDs map[string]uint64 // email to panel user id, for traffic reports
+	lock    sync.RWMutex
+}
+
+// NewSSPanelBackend return a backend of node nodeID, key is the mu key of panel
+func NewSSPanelBackend(baseURL string, key string, nodeID uint64) *SSPanelBackend {
+	query := url.Values{}
+	query.Set("key", key)
+	query.Set("node_id", strconv.FormatUint(nodeID, 10))
+	return &SSPanelBackend{
+		NodeID:  nodeID,
+		client:  newPanelClient(baseURL, query),
+		userIDs: make(map[string]uint64),
+	}
+}
+
+// ssPanelResponse is the envelope of every mod_mu response
+type ssPanelResponse struct {
+	Ret  int         `json:"ret"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data"`
+}
+
+type ssPanelNode struct {
+	Server       string  `json:"server"`
+	TrafficRate  float64 `json:"traffic_rate"`
+	MuOnly       int     `json:"mu_only"`
+	Sort         int     `json:"sort"`
+	NodeGroup    int     `json:"node_group"`
+	NodeClass    int     `json:"node_class"`
+	NodeSpeedLim float64 `json:"node_speedlimit"`
+}
+
+type ssPanelUser struct {
+	ID             uint64 `json:"id"`
+	Email          string `json:"email"`
+	UUID           string `json:"uuid"`
+	Port           uint   `json:"port"`
+	U              uint64 `json:"u"`
+	D              uint64 `json:"d"`
+	TransferEnable uint64 `json:"transfer_enable"`
+}
+
+type ssPanelTraffic struct {
+	UserID uint64 `json:"user_id"`
+	U      uint64 `json:"u"`
+	D      uint64 `json:"d"`
+}
+
+func (b *SSPanelBackend) get(ctx context.Context, path string, data interface{}) error {
+	resp := ssPanelResponse{Data: data}
+	if err := b.client.get(ctx, path, &resp); err != nil {
+		return err
+	}
+	if resp.Ret != 1 {
+		return fmt.Errorf("SSPanel API %s: %s", path, resp.Msg)
+	}
+	return nil
+}
+
+// GetNode implements Backend
+// v2ray settings are packed in server string: host;port;alterId;transport;tls;path=/ws|host=example.com|inside_port=10550
+func (b *SSPanelBackend) GetNode(ctx context.Context) (*models.Node, error) {
+	var n ssPanelNode
+	if err := b.get(ctx, fmt.Sprintf("/mod_mu/nodes/%d/info", b.NodeID), &n); err != nil {
+		return nil, err
+	}
+	fields := strings.Split(n.Server, ";")
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("unsupported SSPanel server string %q", n.Server)
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in SSPanel server string %q", n.Server)
+	}
+	if len(fields) > 5 {
+		for _, extra := range strings.Split(fields[5], "|") {
+			kv := strings.SplitN(extra, "=", 2)
+			if len(kv) == 2 && kv[0] == "inside_port" {
+				if port, err = strconv.ParseUint(kv[1], 10, 32); err != nil {
+					return nil, fmt.Errorf("invalid inside_port in SSPanel server string %q", n.Server)
+				}
+			}
+		}
+	}
+
+	node := &models.Node{
+		Host:  fields[0],
+		Ports: fields[1],
+	}
+	node.Settings.Port = uint(port)
+	node.Settings.VmessSetting.StreamSettings.TransportProtocol = transportName(fields[3])
+	return node, nil
+}
+
+// ListUsers implements Backend
+func (b *SSPanelBackend) ListUsers(ctx context.Context) ([]models.User, error) {
+	panelUsers, err := b.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]models.User, 0, len(panelUsers))
+	for _, u := range panelUsers {
+		users = append(users, models.User{
+			Email:          ssPanelEmail(&u),
+			Username:       strconv.FormatUint(u.ID, 10),
+			CurrentTraffic: u.U + u.D,
+			MaxTraffic:     u.TransferEnable,
+		})
+	}
+	return users, nil
+}
+
+// ListServices implements Backend
+// SSPanel has no services, every user gets one on the node
+func (b *SSPanelBackend) ListServices(ctx context.Context) ([]models.Service, error) {
+	panelUsers, err := b.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	node, err := b.GetNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]models.Service, 0, len(panelUsers))
+	for _, u := range panelUsers {
+		s := models.Service{
+			ID:       u.ID,
+			UserID:   u.ID,
+			NodeID:   b.NodeID,
+			Host:     node.Host,
+			Port:     node.Settings.Port,
+			Protocol: "vmess",
+		}
+		s.VmessUser = models.VmessUser{
+			Email: ssPanelEmail(&u),
+			UUID:  u.UUID,
+		}
+		s.VmessSetting = node.VmessSetting
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// ReportTraffic implements Backend
+func (b *SSPanelBackend) ReportTraffic(ctx context.Context, traffic []models.Traffic) error {
+	data := make([]ssPanelTraffic, 0, len(traffic))
+	// Users not listed yet, or renamed in panel, are kept by caller until they are known
+	var unknown []models.Traffic
+	b.lock.RLock()
+	for _, t := range traffic {
+		id, found := b.userIDs[t.User.Email]
+		if !found {
+			unknown = append(unknown, t)
+			continue
+		}
+		data = append(data, ssPanelTraffic{UserID: id, U: t.Uplink, D: t.Downlink})
+	}
+	b.lock.RUnlock()
+	if len(data) == 0 {
+		return unknownUsers(unknown)
+	}
+
+	var resp ssPanelResponse
+	if err := b.client.post(ctx, "/mod_mu/users/traffic", map[string]interface{}{"data": data}, &resp); err != nil {
+		return err
+	}
+	if resp.Ret != 1 {
+		return errors.New("SSPanel API /mod_mu/users/traffic: " + resp.Msg)
+	}
+	return unknownUsers(unknown)
+}
+
+func (b *SSPanelBackend) listUsers(ctx context.Context) ([]ssPanelUser, error) {
+	var users []ssPanelUser
+	if err := b.get(ctx, "/mod_mu/users", &users); err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	for i := range users {
+		b.userIDs[ssPanelEmail(&users[i])] = users[i].ID
+	}
+	b.lock.Unlock()
+	return users, nil
+}
+
+// ssPanelEmail is the v2ray email of a panel user
+// older panels do not send email, so one is made up from user id
+func ssPanelEmail(u *ssPanelUser) string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return fmt.Sprintf("user%d@sspanel.local", u.ID)
+}
@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// V2BoardBackend talk to panels exposing the V2Board Deepbwork server API
+type V2BoardBackend struct {
+	NodeID  uint64
+	client  *panelClient
+	userIDs map[string]uint64 // email to panel user id, for traffic reports
+	lock    sync.RWMutex
+}
+
+// NewV2BoardBackend return a backend of node nodeID, token is the server token of panel
+// localPort is the v2ray API port V2Board puts in generated config, unused by rayagent but required by the API
+func NewV2BoardBackend(baseURL string, token string, nodeID uint64, localPort uint) *V2BoardBackend {
+	query := url.Values{}
+	query.Set("token", token)
+	query.Set("node_id", strconv.FormatUint(nodeID, 10))
+	query.Set("local_port", strconv.FormatUint(uint64(localPort), 10))
+	return &V2BoardBackend{
+		NodeID:  nodeID,
+		client:  newPanelClient(baseURL, query),
+		userIDs: make(map[string]uint64),
+	}
+}
+
+// v2boardConfig is the part of generated v2ray config we need
+type v2boardConfig struct {
+	Inbounds []struct {
+		Port           uint   `json:"port"`
+		Protocol       string `json:"protocol"`
+		StreamSettings struct {
+			Network string `json:"network"`
+		} `json:"streamSettings"`
+	} `json:"inbounds"`
+}
+
+type v2boardUser struct {
+	ID             uint64 `json:"id"`
+	U              uint64 `json:"u"`
+	D              uint64 `json:"d"`
+	TransferEnable uint64 `json:"transfer_enable"`
+	V2RayUser      struct {
+		UUID    string `json:"uuid"`
+		Email   string `json:"email"`
+		AlterID uint   `json:"alter_id"`
+	} `json:"v2ray_user"`
+}
+
+type v2boardTraffic struct {
+	UserID uint64 `json:"user_id"`
+	U      uint64 `json:"u"`
+	D      uint64 `json:"d"`
+}
+
+// GetNode implements Backend
+// V2Board hands out a whole v2ray config, the vmess inbound in it describes the node
+func (b *V2BoardBackend) GetNode(ctx context.Context) (*models.Node, error) {
+	var config v2boardConfig
+	if err := b.client.get(ctx, "/api/v1/server/Deepbwork/config", &config); err != nil {
+		return nil, err
+	}
+	for _, inbound := range config.Inbounds {
+		if inbound.Protocol != "vmess" {
+			continue
+		}
+		node := &models.Node{
+			Ports: strconv.FormatUint(uint64(inbound.Port), 10),
+		}
+		node.Settings.Port = inbound.Port
+		node.Settings.VmessSetting.StreamSettings.TransportProtocol = transportName(inbound.StreamSettings.Network)
+		return node, nil
+	}
+	return nil, errors.New("no vmess inbound in V2Board config")
+}
+
+// ListUsers implements Backend
+func (b *V2BoardBackend) ListUsers(ctx context.Context) ([]models.User, error) {
+	panelUsers, err := b.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]models.User, 0, len(panelUsers))
+	for _, u := range panelUsers {
+		users = append(users, models.User{
+			Email:          u.V2RayUser.Email,
+			Username:       strconv.FormatUint(u.ID, 10),
+			CurrentTraffic: u.U + u.D,
+			MaxTraffic:     u.TransferEnable,
+		})
+	}
+	return users, nil
+}
+
+// ListServices implements Backend
+// V2Board has no services, every user gets one on the node
+func (b *V2BoardBackend) ListServices(ctx context.Context) ([]models.Service, error) {
+	panelUsers, err := b.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	node, err := b.GetNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]models.Service, 0, len(panelUsers))
+	for _, u := range panelUsers {
+		s := models.Service{
+			ID:       u.ID,
+			UserID:   u.ID,
+			NodeID:   b.NodeID,
+			Port:     node.Settings.Port,
+			Protocol: "vmess",
+		}
+		s.VmessUser = models.VmessUser{
+			Email:   u.V2RayUser.Email,
+			UUID:    u.V2RayUser.UUID,
+			AlterID: u.V2RayUser.AlterID,
+		}
+		s.VmessSetting = node.VmessSetting
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// ReportTraffic implements Backend
+func (b *V2BoardBackend) ReportTraffic(ctx context.Context, traffic []models.Traffic) error {
+	data := make([]v2boardTraffic, 0, len(traffic))
+	// Users not listed yet, or renamed in panel, are kept by caller until they are known
+	var unknown []models.Traffic
+	b.lock.RLock()
+	for _, t := range traffic {
+		id, found := b.userIDs[t.User.Email]
+		if !found {
+			unknown = append(unknown, t)
+			continue
+		}
+		data = append(data, v2boardTraffic{UserID: id, U: t.Uplink, D: t.Downlink})
+	}
+	b.lock.RUnlock()
+	if len(data) == 0 {
+		return unknownUsers(unknown)
+	}
+	if err := b.client.post(ctx, "/api/v1/server/Deepbwork/submit", data, nil); err != nil {
+		return err
+	}
+	return unknownUsers(unknown)
+}
+
+func (b *V2BoardBackend) listUsers(ctx context.Context) ([]v2boardUser, error) {
+	var resp struct {
+		Msg  string        `json:"msg"`
+		Data []v2boardUser `json:"data"`
+	}
+	if err := b.client.get(ctx, "/api/v1/server/Deepbwork/user", &resp); err != nil {
+		return nil, err
+	}
+	if resp.Msg != "" && resp.Msg != "ok" {
+		return nil, fmt.Errorf("V2Board API /api/v1/server/Deepbwork/user: %s", resp.Msg)
+	}
+	b.lock.Lock()
+	for i := range resp.Data {
+		b.userIDs[resp.Data[i].V2RayUser.Email] = resp.Data[i].ID
+	}
+	b.lock.Unlock()
+	return resp.Data, nil
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// Driver talk to a proxy core
+// every driver encodes inbounds and users in protobufs of its own core
+type Driver interface {
+	// CheckNode report whether node settings can be turned into an inbound
+	CheckNode(node *models.Node) error
+	// AddNodeInbound add the inbound shared by all services of a node, with no user
+	AddNodeInbound(tag string, node *models.Node) error
+	// CheckService report whether a service can be turned into an inbound of its own
+	CheckService(s *models.Service) error
+	// AddServiceInbound add an inbound dedicated to a service, in multi inbound mode
+	AddServiceInbound(tag string, s *models.Service) error
+	// RemoveInbound remove an inbound by tag
+	RemoveInbound(tag string) error
+	// AddUser add user of a service to inbound tag
+	AddUser(tag string, s *models.Service) error
+	// DelUser remove user from inbound tag
+	DelUser(tag string, email string) error
+	// GetUserTraffic return and reset uplink and downlink traffic of a user
+	GetUserTraffic(email string) (uint64, uint64, error)
+	// GetInboundTraffic return and reset uplink and downlink traffic of an inbound
+	GetInboundTraffic(tag string) (uint64, uint64, error)
+	// GetSysStats return runtime stats of core, also used to check if core is reachable
+	GetSysStats() (*models.SysStats, error)
+}
+
+func isProtocolValid(p string) bool {
+	var validprotocol map[string]bool = map[string]bool{
+		"tcp":          true,
+		"websocket":    true,
+		"http":         true,
+		"mkcp":         true,
+		"domainsocket": true,
+		"quic":         true,
+	}
+	_, found := validprotocol[p]
+	return found
+}
+
+// protocolOf return proxy protocol of node, vmess if not set
+func protocolOf(p string) string {
+	if p == "" {
+		return "vmess"
+	}
+	return p
+}
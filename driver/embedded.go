@@ -0,0 +1,221 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/utils"
+	"v2ray.com/core"
+	"v2ray.com/core/app/dispatcher"
+	"v2ray.com/core/app/policy"
+	"v2ray.com/core/app/proxyman"
+	"v2ray.com/core/app/stats"
+	"v2ray.com/core/common/serial"
+	"v2ray.com/core/features/inbound"
+	featureStats "v2ray.com/core/features/stats"
+	"v2ray.com/core/proxy"
+	"v2ray.com/core/proxy/freedom"
+
+	// Register all proxies and transports of v2ray
+	_ "v2ray.com/core/main/distro/all"
+)
+
+// Embedded run v2ray in-process and manage it through its feature managers
+// no API port is exposed and there is no second process to supervise
+type Embedded struct {
+	instance       *core.Instance
+	inboundManager inbound.Manager
+	statsManager   featureStats.Manager
+	startedAt      time.Time
+}
+
+// NewEmbedded start a v2ray instance with a base config
+// holding no inbound, a freedom outbound, and stats of every user
+func NewEmbedded() (*Embedded, error) {
+	instance, err := core.New(baseConfig())
+	if err != nil {
+		return nil, fmt.Errorf("Error Creating V2Ray Instance: %w", err)
+	}
+	if err := instance.Start(); err != nil {
+		return nil, fmt.Errorf("Error Starting V2Ray Instance: %w", err)
+	}
+	return &Embedded{
+		instance:       instance,
+		inboundManager: instance.GetFeature(inbound.ManagerType()).(inbound.Manager),
+		statsManager:   instance.GetFeature(featureStats.ManagerType()).(featureStats.Manager),
+		startedAt:      time.Now(),
+	}, nil
+}
+
+// baseConfig is what v2ray needs besides inbounds rayagent adds later
+func baseConfig() *core.Config {
+	return &core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&dispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.InboundConfig{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+			serial.ToTypedMessage(&stats.Config{}),
+			serial.ToTypedMessage(&policy.Config{
+				Level: map[uint32]*policy.Policy{
+					0: {
+						Stats: &policy.Policy_Stats{
+							UserUplink:   true,
+							UserDownlink: true,
+						},
+					},
+				},
+				System: &policy.SystemPolicy{
+					Stats: &policy.SystemPolicy_Stats{
+						InboundUplink:   true,
+						InboundDownlink: true,
+					},
+				},
+			}),
+		},
+		Outbound: []*core.OutboundHandlerConfig{{
+			ProxySettings: serial.ToTypedMessage(&freedom.Config{}),
+		}},
+	}
+}
+
+// Close shut down v2ray instance
+func (e *Embedded) Close() error {
+	return e.instance.Close()
+}
+
+// CheckNode implements Driver
+func (e *Embedded) CheckNode(node *models.Node) error {
+	_, err := genVmessInbound("", node)
+	return err
+}
+
+// AddNodeInbound implements Driver
+func (e *Embedded) AddNodeInbound(tag string, node *models.Node) error {
+	config, err := genVmessInbound(tag, node)
+	if err != nil {
+		return err
+	}
+	return e.addInbound(config)
+}
+
+// CheckService implements Driver
+func (e *Embedded) CheckService(s *models.Service) error {
+	if protocolOf(s.Protocol) != "vmess" {
+		return errors.New("embedded driver only supports vmess, use xray for " + s.Protocol)
+	}
+	return nil
+}
+
+// AddServiceInbound implements Driver
+func (e *Embedded) AddServiceInbound(tag string, s *models.Service) error {
+	if protocolOf(s.Protocol) != "vmess" {
+		return errors.New("embedded driver only supports vmess, use xray for " + s.Protocol)
+	}
+	config := utils.ConvertVmessInbound(s)
+	config.Tag = tag
+	return e.addInbound(config)
+}
+
+// RemoveInbound implements Driver
+func (e *Embedded) RemoveInbound(tag string) error {
+	return e.inboundManager.RemoveHandler(context.Background(), tag)
+}
+
+// AddUser implements Driver
+func (e *Embedded) AddUser(tag string, s *models.Service) error {
+	if protocolOf(s.Protocol) != "vmess" {
+		return errors.New("embedded driver only supports vmess, use xray for " + s.Protocol)
+	}
+	um, err := e.userManager(tag)
+	if err != nil {
+		return err
+	}
+	user, err := utils.ConvertService(s).ToMemoryUser()
+	if err != nil {
+		return err
+	}
+	return um.AddUser(context.Background(), user)
+}
+
+// DelUser implements Driver
+func (e *Embedded) DelUser(tag string, email string) error {
+	um, err := e.userManager(tag)
+	if err != nil {
+		return err
+	}
+	return um.RemoveUser(context.Background(), email)
+}
+
+// GetUserTraffic implements Driver
+func (e *Embedded) GetUserTraffic(email string) (uint64, uint64, error) {
+	return e.resetCounter(fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email)),
+		e.resetCounter(fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email)),
+		nil
+}
+
+// GetInboundTraffic implements Driver
+func (e *Embedded) GetInboundTraffic(tag string) (uint64, uint64, error) {
+	return e.resetCounter(fmt.Sprintf("inbound>>>%s>>>traffic>>>uplink", tag)),
+		e.resetCounter(fmt.Sprintf("inbound>>>%s>>>traffic>>>downlink", tag)),
+		nil
+}
+
+// GetSysStats implements Driver
+// v2ray runs in this process, so these are stats of rayagent itself
+func (e *Embedded) GetSysStats() (*models.SysStats, error) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &models.SysStats{
+		NumGoroutine: uint32(runtime.NumGoroutine()),
+		NumGC:        m.NumGC,
+		Alloc:        m.Alloc,
+		TotalAlloc:   m.TotalAlloc,
+		Sys:          m.Sys,
+		Mallocs:      m.Mallocs,
+		Frees:        m.Frees,
+		LiveObjects:  m.Mallocs - m.Frees,
+		PauseTotalNs: m.PauseTotalNs,
+		Uptime:       uint32(time.Since(e.startedAt).Seconds()),
+	}, nil
+}
+
+func (e *Embedded) addInbound(config *core.InboundHandlerConfig) error {
+	raw, err := core.CreateObject(e.instance, config)
+	if err != nil {
+		return err
+	}
+	handler, ok := raw.(inbound.Handler)
+	if !ok {
+		return errors.New("not an inbound handler")
+	}
+	return e.inboundManager.AddHandler(context.Background(), handler)
+}
+
+func (e *Embedded) userManager(tag string) (proxy.UserManager, error) {
+	handler, err := e.inboundManager.GetHandler(context.Background(), tag)
+	if err != nil {
+		return nil, err
+	}
+	gi, ok := handler.(proxy.GetInbound)
+	if !ok {
+		return nil, fmt.Errorf("inbound %s cannot manage users", tag)
+	}
+	um, ok := gi.GetInbound().(proxy.UserManager)
+	if !ok {
+		return nil, fmt.Errorf("inbound %s cannot manage users", tag)
+	}
+	return um, nil
+}
+
+// resetCounter return and reset a counter, counters not created yet count as zero
+func (e *Embedded) resetCounter(name string) uint64 {
+	counter := e.statsManager.GetCounter(name)
+	if counter == nil {
+		return 0
+	}
+	return uint64(counter.Set(0))
+}
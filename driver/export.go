@@ -0,0 +1,182 @@
+package driver
+
+import (
+	"errors"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/utils"
+	"v2ray.com/core"
+	"v2ray.com/core/app/proxyman"
+	"v2ray.com/core/common/protocol"
+	"v2ray.com/core/common/serial"
+	"v2ray.com/core/proxy/vmess"
+	vmessInbound "v2ray.com/core/proxy/vmess/inbound"
+)
+
+// ExportInbounds return v2ray json inbounds with users, the same v2ray driver would apply
+// services are expected to be filtered already
+func ExportInbounds(tag string, node *models.Node, services []models.Service) ([]interface{}, error) {
+	inbounds := make([]interface{}, 0)
+
+	// Multi inbound mode, one inbound per service
+	if node.HasMultiPort {
+		for i := range services {
+			if protocolOf(services[i].Protocol) != "vmess" {
+				return nil, errors.New("v2ray config only supports vmess, service " + services[i].Email + " is " + services[i].Protocol)
+			}
+			inbound, err := inboundJSON(utils.ConvertVmessInbound(&services[i]))
+			if err != nil {
+				return nil, err
+			}
+			inbounds = append(inbounds, inbound)
+		}
+		return inbounds, nil
+	}
+
+	// Single inbound mode, every service is a user of node inbound
+	for i := range services {
+		if protocolOf(services[i].Protocol) != "vmess" {
+			return nil, errors.New("v2ray config only supports vmess, service " + services[i].Email + " is " + services[i].Protocol)
+		}
+	}
+	config, err := genVmessInbound(tag, node)
+	if err != nil {
+		return nil, err
+	}
+	if hasRawInbound(node) {
+		inbound, err := rawInboundJSON(tag, node, services)
+		if err != nil {
+			return nil, err
+		}
+		return append(inbounds, inbound), nil
+	}
+	proxy, err := config.ProxySettings.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	vmessConfig, ok := proxy.(*vmessInbound.Config)
+	if !ok {
+		return nil, errors.New("inbound is not vmess")
+	}
+	for i := range services {
+		vmessConfig.User = append(vmessConfig.User, utils.ConvertService(&services[i]))
+	}
+	config.ProxySettings = serial.ToTypedMessage(vmessConfig)
+	inbound, err := inboundJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	return append(inbounds, inbound), nil
+}
+
+// inboundJSON turn a vmess inbound protobuf into v2ray json
+func inboundJSON(config *core.InboundHandlerConfig) (map[string]interface{}, error) {
+	receiver, err := config.ReceiverSettings.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := receiver.(*proxyman.ReceiverConfig)
+	if !ok || r.PortRange == nil {
+		return nil, errors.New("inbound has no port")
+	}
+	proxy, err := config.ProxySettings.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := proxy.(*vmessInbound.Config)
+	if !ok {
+		return nil, errors.New("inbound is not vmess")
+	}
+
+	clients := make([]interface{}, 0, len(p.User))
+	for _, u := range p.User {
+		client, err := clientJSON(u)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	settings := map[string]interface{}{
+		"clients":                   clients,
+		"disableInsecureEncryption": p.SecureEncryptionOnly,
+	}
+	if p.Default != nil {
+		settings["default"] = map[string]interface{}{
+			"alterId": p.Default.AlterId,
+			"level":   p.Default.Level,
+		}
+	}
+
+	inbound := map[string]interface{}{
+		"tag":      config.Tag,
+		"port":     r.PortRange.From,
+		"protocol": "vmess",
+		"settings": settings,
+	}
+	if r.Listen != nil {
+		inbound["listen"] = r.Listen.AsAddress().String()
+	}
+	if r.StreamSettings != nil {
+		inbound["streamSettings"] = map[string]interface{}{
+			"network": networkName(r.StreamSettings.ProtocolName),
+		}
+	}
+	if r.SniffingSettings != nil {
+		inbound["sniffing"] = map[string]interface{}{
+			"enabled":      r.SniffingSettings.Enabled,
+			"destOverride": r.SniffingSettings.DestinationOverride,
+		}
+	}
+	return inbound, nil
+}
+
+// rawInboundJSON fill tag and users into raw inbound of node
+func rawInboundJSON(tag string, node *models.Node, services []models.Service) (map[string]interface{}, error) {
+	inbound, err := rawInbound(tag, node, "vmess")
+	if err != nil {
+		return nil, err
+	}
+	settings := inbound["settings"].(map[string]interface{})
+	clients := make([]interface{}, 0, len(services))
+	for i := range services {
+		client, err := clientJSON(utils.ConvertService(&services[i]))
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	settings["clients"] = clients
+	return inbound, nil
+}
+
+// clientJSON turn a vmess user protobuf into v2ray json client
+func clientJSON(u *protocol.User) (map[string]interface{}, error) {
+	account, err := u.Account.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	a, ok := account.(*vmess.Account)
+	if !ok {
+		return nil, errors.New("user " + u.Email + " is not vmess")
+	}
+	return map[string]interface{}{
+		"id":      a.Id,
+		"alterId": a.AlterId,
+		"email":   u.Email,
+		"level":   u.Level,
+	}, nil
+}
+
+// networkName map transport protocol name to network name used in v2ray json
+func networkName(transport string) string {
+	switch transport {
+	case "websocket":
+		return "ws"
+	case "mkcp":
+		return "kcp"
+	case "http":
+		return "h2"
+	default:
+		return transport
+	}
+}
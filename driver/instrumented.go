@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"github.com/coolray-dev/rayagent/metrics"
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// Instrumented count every change pushed to core through the driver it wraps
+type Instrumented struct {
+	Driver
+}
+
+// NewInstrumented wrap d so apply operations show up in metrics
+func NewInstrumented(d Driver) *Instrumented {
+	return &Instrumented{Driver: d}
+}
+
+// AddNodeInbound implements Driver
+func (i *Instrumented) AddNodeInbound(tag string, node *models.Node) error {
+	err := i.Driver.AddNodeInbound(tag, node)
+	metrics.ApplyOp("add_inbound", err)
+	return err
+}
+
+// AddServiceInbound implements Driver
+func (i *Instrumented) AddServiceInbound(tag string, s *models.Service) error {
+	err := i.Driver.AddServiceInbound(tag, s)
+	metrics.ApplyOp("add_inbound", err)
+	return err
+}
+
+// RemoveInbound implements Driver
+func (i *Instrumented) RemoveInbound(tag string) error {
+	err := i.Driver.RemoveInbound(tag)
+	metrics.ApplyOp("remove_inbound", err)
+	return err
+}
+
+// AddUser implements Driver
+func (i *Instrumented) AddUser(tag string, s *models.Service) error {
+	err := i.Driver.AddUser(tag, s)
+	metrics.ApplyOp("add_user", err)
+	return err
+}
+
+// DelUser implements Driver
+func (i *Instrumented) DelUser(tag string, email string) error {
+	err := i.Driver.DelUser(tag, email)
+	metrics.ApplyOp("del_user", err)
+	return err
+}
+
+// Close close wrapped driver if it can be closed
+func (i *Instrumented) Close() error {
+	if closer, ok := i.Driver.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
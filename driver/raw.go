@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coolray-dev/rayagent/models"
+	"v2ray.com/core"
+	"v2ray.com/core/infra/conf"
+)
+
+// hasRawInbound report whether node carries a raw v2ray json inbound
+func hasRawInbound(node *models.Node) bool {
+	return len(node.Inbound) != 0 && string(node.Inbound) != "null"
+}
+
+// rawInbound decode raw inbound of node and check what every core needs of it
+// protocol must agree with node and be one of protocols, and a port must be set
+// clients in json are dropped and tag is filled in, users come from backend as with any other inbound
+func rawInbound(tag string, node *models.Node, protocols ...string) (map[string]interface{}, error) {
+	inbound := make(map[string]interface{})
+	if err := json.Unmarshal(node.Inbound, &inbound); err != nil {
+		return nil, fmt.Errorf("Error Parsing Raw Inbound: %w", err)
+	}
+
+	head, _ := inbound["protocol"].(string)
+	proxy := strings.ToLower(head)
+	if proxy != protocolOf(node.Protocol) {
+		return nil, fmt.Errorf("raw inbound protocol %s does not match node protocol %s", head, protocolOf(node.Protocol))
+	}
+	supported := false
+	for _, p := range protocols {
+		supported = supported || p == proxy
+	}
+	if !supported {
+		return nil, fmt.Errorf("raw inbound protocol %s is not supported, only %s", head, strings.Join(protocols, " and "))
+	}
+	if port, found := inbound["port"]; !found || port == nil || port == float64(0) || port == "" {
+		return nil, errors.New("raw inbound has no port")
+	}
+
+	settings, _ := inbound["settings"].(map[string]interface{})
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+	delete(settings, "clients")
+	inbound["settings"] = settings
+	inbound["tag"] = tag
+	return inbound, nil
+}
+
+// decodeRawInbound decode checked raw inbound of node into detour config of a core
+func decodeRawInbound(tag string, node *models.Node, detour interface{}, protocols ...string) error {
+	inbound, err := rawInbound(tag, node, protocols...)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(inbound)
+	if err != nil {
+		return fmt.Errorf("Error Parsing Raw Inbound: %w", err)
+	}
+	if err := json.Unmarshal(data, detour); err != nil {
+		return fmt.Errorf("Error Parsing Raw Inbound: %w", err)
+	}
+	return nil
+}
+
+// genRawInbound build a vmess inbound from raw json in node settings with NO USER
+func genRawInbound(tag string, node *models.Node) (*core.InboundHandlerConfig, error) {
+	detour := new(conf.InboundDetourConfig)
+	if err := decodeRawInbound(tag, node, detour, "vmess"); err != nil {
+		return nil, err
+	}
+	config, err := detour.Build()
+	if err != nil {
+		return nil, fmt.Errorf("Error Building Raw Inbound: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,169 @@
+package driver
+
+import (
+	"errors"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"v2ray.com/core"
+	"v2ray.com/core/app/proxyman"
+	"v2ray.com/core/common/net"
+	"v2ray.com/core/common/protocol"
+	"v2ray.com/core/common/serial"
+	vmessInbound "v2ray.com/core/proxy/vmess/inbound"
+	"v2ray.com/core/transport/internet"
+	"v2ray.com/core/transport/internet/websocket"
+)
+
+// V2Ray drive an external v2ray through its gRPC API
+type V2Ray struct {
+	handlerServiceClient *modules.HandlerServiceClient
+	statsServiceClient   *modules.StatsServiceClient
+}
+
+// NewV2Ray return a driver talking to v2ray over conn
+func NewV2Ray(conn *grpc.ClientConn) *V2Ray {
+	return &V2Ray{
+		handlerServiceClient: modules.NewHandlerServiceClient(conn),
+		statsServiceClient:   modules.NewStatsServiceClient(conn),
+	}
+}
+
+// CheckNode implements Driver
+func (v *V2Ray) CheckNode(node *models.Node) error {
+	_, err := genVmessInbound("", node)
+	return err
+}
+
+// AddNodeInbound implements Driver
+func (v *V2Ray) AddNodeInbound(tag string, node *models.Node) error {
+	config, err := genVmessInbound(tag, node)
+	if err != nil {
+		return err
+	}
+	return v.handlerServiceClient.AddInbound(config)
+}
+
+// CheckService implements Driver
+func (v *V2Ray) CheckService(s *models.Service) error {
+	if protocolOf(s.Protocol) != "vmess" {
+		return errors.New("v2ray driver only supports vmess, use xray for " + s.Protocol)
+	}
+	return nil
+}
+
+// AddServiceInbound implements Driver
+func (v *V2Ray) AddServiceInbound(tag string, s *models.Service) error {
+	if protocolOf(s.Protocol) != "vmess" {
+		return errors.New("v2ray driver only supports vmess, use xray for " + s.Protocol)
+	}
+	config := utils.ConvertVmessInbound(s)
+	config.Tag = tag
+	return v.handlerServiceClient.AddInbound(config)
+}
+
+// RemoveInbound implements Driver
+func (v *V2Ray) RemoveInbound(tag string) error {
+	return v.handlerServiceClient.RemoveInbound(tag)
+}
+
+// AddUser implements Driver
+func (v *V2Ray) AddUser(tag string, s *models.Service) error {
+	if protocolOf(s.Protocol) != "vmess" {
+		return errors.New("v2ray driver only supports vmess, use xray for " + s.Protocol)
+	}
+	return v.handlerServiceClient.AddUser(tag, utils.ConvertService(s))
+}
+
+// DelUser implements Driver
+func (v *V2Ray) DelUser(tag string, email string) error {
+	return v.handlerServiceClient.DelUser(tag, email)
+}
+
+// GetUserTraffic implements Driver
+func (v *V2Ray) GetUserTraffic(email string) (uint64, uint64, error) {
+	return v.statsServiceClient.GetUserUplinkDownlink(email)
+}
+
+// GetInboundTraffic implements Driver
+func (v *V2Ray) GetInboundTraffic(tag string) (uint64, uint64, error) {
+	return v.statsServiceClient.GetInboundUplinkDownlink(tag)
+}
+
+// GetSysStats implements Driver
+func (v *V2Ray) GetSysStats() (*models.SysStats, error) {
+	return v.statsServiceClient.GetSysStats()
+}
+
+// genVmessInbound generate a vmess inbound with NO USER
+func genVmessInbound(tag string, node *models.Node) (*core.InboundHandlerConfig, error) {
+	if hasRawInbound(node) {
+		return genRawInbound(tag, node)
+	}
+
+	// Get port from nodeinfo and validate
+	port, err := net.PortFromInt(uint32(node.Port))
+	if err != nil {
+		utils.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"port":  node.Port,
+		}).Error("Invalid Port")
+		return nil, errors.New("Invalid Port")
+	}
+
+	if protocolOf(node.Protocol) != "vmess" {
+		return nil, errors.New("v2ray driver only supports vmess, use xray for " + node.Protocol)
+	}
+
+	// Validate protocol
+	if !isProtocolValid(node.VmessSetting.StreamSettings.TransportProtocol) {
+		utils.Log.WithFields(logrus.Fields{
+			"protocol": node.TransportProtocol,
+		}).Error("Invalid Protocol")
+		return nil, errors.New("Invalid Protocol")
+	}
+	config := &core.InboundHandlerConfig{
+		Tag: tag,
+		ReceiverSettings: serial.ToTypedMessage(
+			&proxyman.ReceiverConfig{
+				PortRange: net.SinglePortRange(port),
+				Listen:    net.NewIPOrDomain(net.ParseAddress("0.0.0.0")), // hard coded
+				AllocationStrategy: &proxyman.AllocationStrategy{
+					Type: proxyman.AllocationStrategy_Always,
+				}, // Must have
+				StreamSettings: &internet.StreamConfig{
+					//Protocol:     internet.TransportProtocol(internet.TransportProtocol_value[node.VmessSetting.StreamSettings.TransportProtocol]), // Deprecated
+					ProtocolName: node.VmessSetting.StreamSettings.TransportProtocol,
+					TransportSettings: []*internet.TransportConfig{&internet.TransportConfig{
+						//Protocol:     internet.TransportProtocol(internet.TransportProtocol_value[node.VmessSetting.StreamSettings.TransportProtocol]), // Deprecated
+						ProtocolName: node.VmessSetting.StreamSettings.TransportProtocol,
+						Settings: serial.ToTypedMessage(&websocket.Config{
+							Path: "", // leave for future
+						}),
+					}},
+				},
+				ReceiveOriginalDestination: true,
+				SniffingSettings: &proxyman.SniffingConfig{
+					Enabled:             true,
+					DestinationOverride: []string{"http", "tls"},
+				},
+			},
+		),
+		ProxySettings: serial.ToTypedMessage(
+			&vmessInbound.Config{
+				User: []*protocol.User{},
+				Default: &vmessInbound.DefaultConfig{
+					AlterId: 64, // hard coded
+				},
+				//Detour: &vmessInbound.DetourConfig{
+				//	To: "", // No detour, not support yet
+				//},
+				SecureEncryptionOnly: true,
+			},
+		),
+	}
+	return config, nil
+}
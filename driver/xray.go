@@ -0,0 +1,353 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/xtls/xray-core/app/proxyman"
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/proxy/vless"
+	vlessInbound "github.com/xtls/xray-core/proxy/vless/inbound"
+	"github.com/xtls/xray-core/proxy/vmess"
+	vmessInbound "github.com/xtls/xray-core/proxy/vmess/inbound"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/http"
+	"github.com/xtls/xray-core/transport/internet/kcp"
+	"github.com/xtls/xray-core/transport/internet/quic"
+	"github.com/xtls/xray-core/transport/internet/tcp"
+	"github.com/xtls/xray-core/transport/internet/websocket"
+	"github.com/xtls/xray-core/transport/internet/xtls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Xray drive an external xray through its gRPC API
+// besides vmess it supports vless, with XTLS when flow asks for it
+type Xray struct {
+	CertFile             string // certificate for XTLS
+	KeyFile              string // key for XTLS
+	handlerServiceClient handlerService.HandlerServiceClient
+	statsServiceClient   statsService.StatsServiceClient
+}
+
+// NewXray return a driver talking to xray over conn
+func NewXray(conn *grpc.ClientConn) *Xray {
+	return &Xray{
+		handlerServiceClient: handlerService.NewHandlerServiceClient(conn),
+		statsServiceClient:   statsService.NewStatsServiceClient(conn),
+	}
+}
+
+// CheckNode implements Driver
+func (x *Xray) CheckNode(node *models.Node) error {
+	if hasRawInbound(node) {
+		_, err := x.genRawInbound("", node)
+		return err
+	}
+	_, err := x.genInbound("", node.Port, protocolOf(node.Protocol), node.VmessSetting.StreamSettings.TransportProtocol, node.VlessSetting.Flow, nil)
+	return err
+}
+
+// AddNodeInbound implements Driver
+func (x *Xray) AddNodeInbound(tag string, node *models.Node) error {
+	if hasRawInbound(node) {
+		config, err := x.genRawInbound(tag, node)
+		if err != nil {
+			return err
+		}
+		return x.addInbound(config)
+	}
+	config, err := x.genInbound(tag, node.Port, protocolOf(node.Protocol), node.VmessSetting.StreamSettings.TransportProtocol, node.VlessSetting.Flow, nil)
+	if err != nil {
+		return err
+	}
+	return x.addInbound(config)
+}
+
+// CheckService implements Driver
+func (x *Xray) CheckService(s *models.Service) error {
+	user, err := convertXrayUser(s)
+	if err != nil {
+		return err
+	}
+	_, err = x.genInbound("", s.Port, protocolOf(s.Protocol), s.VmessSetting.StreamSettings.TransportProtocol, s.VlessUser.Flow, user)
+	return err
+}
+
+// AddServiceInbound implements Driver
+func (x *Xray) AddServiceInbound(tag string, s *models.Service) error {
+	user, err := convertXrayUser(s)
+	if err != nil {
+		return err
+	}
+	config, err := x.genInbound(tag, s.Port, protocolOf(s.Protocol), s.VmessSetting.StreamSettings.TransportProtocol, s.VlessUser.Flow, user)
+	if err != nil {
+		return err
+	}
+	return x.addInbound(config)
+}
+
+// RemoveInbound implements Driver
+func (x *Xray) RemoveInbound(tag string) error {
+	_, err := x.handlerServiceClient.RemoveInbound(context.Background(), &handlerService.RemoveInboundRequest{
+		Tag: tag,
+	})
+	return err
+}
+
+// AddUser implements Driver
+func (x *Xray) AddUser(tag string, s *models.Service) error {
+	user, err := convertXrayUser(s)
+	if err != nil {
+		return err
+	}
+	_, err = x.handlerServiceClient.AlterInbound(context.Background(), &handlerService.AlterInboundRequest{
+		Tag:       tag,
+		Operation: serial.ToTypedMessage(&handlerService.AddUserOperation{User: user}),
+	})
+	return err
+}
+
+// DelUser implements Driver
+func (x *Xray) DelUser(tag string, email string) error {
+	_, err := x.handlerServiceClient.AlterInbound(context.Background(), &handlerService.AlterInboundRequest{
+		Tag:       tag,
+		Operation: serial.ToTypedMessage(&handlerService.RemoveUserOperation{Email: email}),
+	})
+	return err
+}
+
+// GetUserTraffic implements Driver
+func (x *Xray) GetUserTraffic(email string) (uint64, uint64, error) {
+	up, err := x.getStats(fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	down, err := x.getStats(fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	return up, down, nil
+}
+
+// GetInboundTraffic implements Driver
+func (x *Xray) GetInboundTraffic(tag string) (uint64, uint64, error) {
+	up, err := x.getStats(fmt.Sprintf("inbound>>>%s>>>traffic>>>uplink", tag), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	down, err := x.getStats(fmt.Sprintf("inbound>>>%s>>>traffic>>>downlink", tag), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	return up, down, nil
+}
+
+// GetSysStats implements Driver
+func (x *Xray) GetSysStats() (*models.SysStats, error) {
+	res, err := x.statsServiceClient.GetSysStats(context.Background(), &statsService.SysStatsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &models.SysStats{
+		NumGoroutine: res.NumGoroutine,
+		NumGC:        res.NumGC,
+		Alloc:        res.Alloc,
+		TotalAlloc:   res.TotalAlloc,
+		Sys:          res.Sys,
+		Mallocs:      res.Mallocs,
+		Frees:        res.Frees,
+		LiveObjects:  res.LiveObjects,
+		PauseTotalNs: res.PauseTotalNs,
+		Uptime:       res.Uptime,
+	}, nil
+}
+
+func (x *Xray) addInbound(config *core.InboundHandlerConfig) error {
+	_, err := x.handlerServiceClient.AddInbound(context.Background(), &handlerService.AddInboundRequest{
+		Inbound: config,
+	})
+	return err
+}
+
+func (x *Xray) getStats(name string, reset bool) (uint64, error) {
+	res, err := x.statsServiceClient.GetStats(context.Background(), &statsService.GetStatsRequest{
+		Name:   name,
+		Reset_: reset,
+	})
+	if err != nil {
+		if status, ok := status.FromError(err); ok && strings.HasSuffix(status.Message(), fmt.Sprintf("%s not found.", name)) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return uint64(res.Stat.Value), nil
+}
+
+// genInbound generate a vmess or vless inbound, with user if not nil
+func (x *Xray) genInbound(tag string, p uint, proxy string, transport string, flow string, user *protocol.User) (*core.InboundHandlerConfig, error) {
+	port, err := net.PortFromInt(uint32(p))
+	if err != nil {
+		return nil, errors.New("Invalid Port")
+	}
+	if !isProtocolValid(transport) {
+		return nil, errors.New("Invalid Protocol")
+	}
+	transportSettings, err := xrayTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	users := []*protocol.User{}
+	if user != nil {
+		users = append(users, user)
+	}
+
+	streamSettings := &internet.StreamConfig{
+		ProtocolName: transport,
+		TransportSettings: []*internet.TransportConfig{{
+			ProtocolName: transport,
+			Settings:     transportSettings,
+		}},
+	}
+
+	var proxySettings *serial.TypedMessage
+	switch proxy {
+	case "vmess":
+		proxySettings = serial.ToTypedMessage(&vmessInbound.Config{
+			User: users,
+			Default: &vmessInbound.DefaultConfig{
+				AlterId: 64, // hard coded
+			},
+			SecureEncryptionOnly: true,
+		})
+	case "vless":
+		proxySettings = serial.ToTypedMessage(&vlessInbound.Config{
+			Clients:    users,
+			Decryption: "none",
+		})
+		if strings.HasPrefix(flow, "xtls-rprx") {
+			if transport != "tcp" {
+				return nil, errors.New("XTLS only works over tcp, not " + transport)
+			}
+			security, err := x.xtlsConfig()
+			if err != nil {
+				return nil, err
+			}
+			streamSettings.SecurityType = serial.GetMessageType(security)
+			streamSettings.SecuritySettings = []*serial.TypedMessage{serial.ToTypedMessage(security)}
+		}
+	default:
+		return nil, errors.New("xray driver does not support " + proxy)
+	}
+
+	return &core.InboundHandlerConfig{
+		Tag: tag,
+		ReceiverSettings: serial.ToTypedMessage(
+			&proxyman.ReceiverConfig{
+				PortRange: net.SinglePortRange(port),
+				Listen:    net.NewIPOrDomain(net.ParseAddress("0.0.0.0")), // hard coded
+				AllocationStrategy: &proxyman.AllocationStrategy{
+					Type: proxyman.AllocationStrategy_Always,
+				}, // Must have
+				StreamSettings:             streamSettings,
+				ReceiveOriginalDestination: true,
+				SniffingSettings: &proxyman.SniffingConfig{
+					Enabled:             true,
+					DestinationOverride: []string{"http", "tls"},
+				},
+			},
+		),
+		ProxySettings: proxySettings,
+	}, nil
+}
+
+// xrayTransport return settings of network transport, with defaults of core
+func xrayTransport(transport string) (*serial.TypedMessage, error) {
+	switch transport {
+	case "tcp":
+		return serial.ToTypedMessage(&tcp.Config{}), nil
+	case "websocket":
+		return serial.ToTypedMessage(&websocket.Config{
+			Path: "", // leave for future
+		}), nil
+	case "http":
+		return serial.ToTypedMessage(&http.Config{}), nil
+	case "mkcp":
+		return serial.ToTypedMessage(&kcp.Config{}), nil
+	case "quic":
+		return serial.ToTypedMessage(&quic.Config{}), nil
+	default:
+		// domainsocket listens on a path node settings cannot carry
+		return nil, errors.New("xray driver cannot build " + transport + " transport, use raw inbound")
+	}
+}
+
+// genRawInbound build a vmess or vless inbound from raw json in node settings with NO USER
+func (x *Xray) genRawInbound(tag string, node *models.Node) (*core.InboundHandlerConfig, error) {
+	detour := new(conf.InboundDetourConfig)
+	if err := decodeRawInbound(tag, node, detour, "vmess", "vless"); err != nil {
+		return nil, err
+	}
+	config, err := detour.Build()
+	if err != nil {
+		return nil, fmt.Errorf("Error Building Raw Inbound: %w", err)
+	}
+	return config, nil
+}
+
+func (x *Xray) xtlsConfig() (*xtls.Config, error) {
+	if x.CertFile == "" || x.KeyFile == "" {
+		return nil, errors.New("XTLS needs certificate and key")
+	}
+	cert, err := ioutil.ReadFile(x.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(x.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &xtls.Config{
+		Certificate: []*xtls.Certificate{{
+			Certificate: cert,
+			Key:         key,
+		}},
+	}, nil
+}
+
+// convertXrayUser turn a service into a vmess or vless user
+func convertXrayUser(s *models.Service) (*protocol.User, error) {
+	switch protocolOf(s.Protocol) {
+	case "vmess":
+		return &protocol.User{
+			Level: 0,
+			Email: s.Email,
+			Account: serial.ToTypedMessage(&vmess.Account{
+				Id:      s.UUID,
+				AlterId: 64, // hard coded
+			}),
+		}, nil
+	case "vless":
+		return &protocol.User{
+			Level: 0,
+			Email: s.Email,
+			Account: serial.ToTypedMessage(&vless.Account{
+				Id:         s.UUID,
+				Flow:       s.VlessUser.Flow,
+				Encryption: "none",
+			}),
+		}, nil
+	default:
+		return nil, errors.New("xray driver does not support " + s.Protocol)
+	}
+}
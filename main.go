@@ -1,26 +1,104 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/models"
 	"github.com/coolray-dev/rayagent/modules"
 	"github.com/coolray-dev/rayagent/utils"
 	"github.com/coolray-dev/rayagent/worker"
-	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
+const usage = `Usage: rayagent [command] [flags]
+
+Commands:
+  run        run the agent, default if no command is given
+  sync       sync --once: apply backend state to v2ray once and exit
+  validate   check config, backend and v2ray connectivity
+  status     show status of a running agent through admin API
+  version    print version
+  register   trade a bootstrap token for node credentials
+  export     write a standalone v2ray config of current state
+  import     import clients of an existing v2ray config
+  encrypt    seal a secret read from stdin for use in config
+
+Every command takes --config FILE, run "rayagent COMMAND --help" for its flags
+`
+
 func main() {
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
+	switch command {
+	case "run":
+		run(args)
+	case "sync":
+		syncOnce(args)
+	case "validate":
+		validate(args)
+	case "status":
+		status(args)
+	case "version":
+		fmt.Println("rayagent", utils.Version)
+	case "register":
+		register(args)
+	case "export":
+		export(args)
+	case "import":
+		importConfig(args)
+	case "encrypt":
+		encrypt(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	return
+}
+
+// newFlagSet return flags of a command, every command takes --config
+func newFlagSet(command string) (*pflag.FlagSet, *string) {
+	flags := pflag.NewFlagSet(command, pflag.ExitOnError)
+	config := flags.StringP("config", "c", "", "config file, default config.yml in working directory or /etc/rayagent")
+	return flags, config
+}
+
+// loadConfig load config for command and set log level, exit if config is invalid
+func loadConfig(path string, command string) {
+	if err := modules.LoadConfig(path, command); err != nil {
+		utils.Log.WithError(err).Fatal("Config Error")
+	}
 	setupLog()
+	return
+}
+
+// run start the agent and wait until it is stopped
+// exit status is 0 if every counted traffic was reported on shutdown, 1 otherwise
+func run(args []string) {
+	flags, config := newFlagSet("run")
+	flags.Parse(args)
+	loadConfig(*config, "run")
 
 	// Create a channel to pass signal rayagent process receive
-	sigs := make(chan os.Signal)
-	// Used to implement gracful shutdown
-	signal.Notify(sigs, syscall.SIGINT)
+	sigs := make(chan os.Signal, 1)
+	// Used to implement gracful shutdown, SIGTERM comes from systemd and docker
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	// Create a waitgroup
 	var wg sync.WaitGroup
@@ -29,31 +107,370 @@ func main() {
 	rayagent := worker.NewRayAgent(&wg)
 	rayagent.Start()
 
-	// Monitor signal from channel sigs
+	// Reload config on SIGHUP or when config file is written
+	// reloads run here one at a time, and never during shutdown
+	reloads := make(chan struct{}, 1)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	watcher, err := modules.WatchConfig(func() {
+		select {
+		case reloads <- struct{}{}:
+		default: // one pending reload is enough
+		}
+	})
+	if err != nil {
+		utils.Log.WithError(err).Warn("Error Watching Config File, Reload With SIGHUP Instead")
+	} else {
+		defer watcher.Close()
+	}
+
+	// Do graceful shutdown
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case sig = <-sigs:
+		case <-hups:
+			reload(rayagent)
+		case <-reloads:
+			reload(rayagent)
+		}
+	}
+	signal.Stop(hups)
+	fmt.Println("Shutting down. Caused by", sig)
 	go func() {
-		sig := <-sigs
-		// Do graceful shutdown
-		fmt.Println("Shutting down. Caused by", sig)
-		rayagent.Stop()
+		<-sigs
+		fmt.Println("Killed before shutdown finished")
+		os.Exit(1)
 	}()
+	timeout := time.Duration(modules.Config.GetUint64("agent.shutdowntimeout")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = rayagent.Stop(ctx)
 
 	// Do not exit until all goroutine done
 	wg.Wait()
+	if err != nil {
+		utils.Log.WithError(err).Error("Shutdown Incomplete")
+		cancel()
+		os.Exit(1)
+	}
 	return
 }
 
-func setupLog() {
-	switch modules.Config.GetString("log.level") {
-	case "debug":
-		utils.Log.SetLevel(logrus.DebugLevel)
-	case "info":
-		utils.Log.SetLevel(logrus.InfoLevel)
-	case "warn":
-		utils.Log.SetLevel(logrus.WarnLevel)
-	case "error":
-		utils.Log.SetLevel(logrus.ErrorLevel)
+// reload apply config file to running agent, an invalid config is logged and ignored
+func reload(rayagent *worker.RayAgent) {
+	if err := rayagent.Reload(); err != nil {
+		utils.Log.WithError(err).Error("Config Reload Rejected")
+	}
+	return
+}
+
+// syncOnce apply backend state once, for cron and debugging
+// usage: rayagent sync --once
+func syncOnce(args []string) {
+	flags, config := newFlagSet("sync")
+	once := flags.Bool("once", false, "sync once and exit")
+	flags.Parse(args)
+	if !*once {
+		fmt.Fprintln(os.Stderr, "sync only supports --once, use rayagent run to keep syncing")
+		os.Exit(2)
+	}
+	loadConfig(*config, "sync")
+
+	if err := worker.SyncOnce(); err != nil {
+		utils.Log.WithError(err).Fatal("Error Syncing")
+	}
+	return
+}
+
+// validate check config and connectivity
+// usage: rayagent validate
+func validate(args []string) {
+	flags, config := newFlagSet("validate")
+	flags.Parse(args)
+	if err := modules.LoadConfig(*config, "validate"); err != nil {
+		fmt.Printf("[FAIL] config: %s\n", err)
+		os.Exit(1)
+	}
+	setupLog()
+	fmt.Printf("[ OK ] config %s\n", modules.Config.ConfigFileUsed())
+
+	if !worker.Validate(os.Stdout) {
+		os.Exit(1)
+	}
+	return
+}
+
+// status query a running agent through admin API
+// usage: rayagent status [--json]
+func status(args []string) {
+	flags, config := newFlagSet("status")
+	raw := flags.Bool("json", false, "print raw JSON from admin API")
+	flags.Parse(args)
+	loadConfig(*config, "status")
+	listen := modules.Config.GetString("admin.listen")
+	if listen == "" {
+		utils.Log.Fatal("admin.listen not set, status needs admin API of running agent")
+	}
+
+	var resp struct {
+		Status models.NodeStatus `json:"status"`
+		Outbox int               `json:"outbox"`
+		Queued map[string]int    `json:"queued"`
+	}
+	var services struct {
+		Services []worker.ServiceState `json:"services"`
+	}
+	if err := adminGet(listen, "/status", &resp); err != nil {
+		utils.Log.WithError(err).Fatal("Error Querying Agent")
+	}
+	if err := adminGet(listen, "/services", &services); err != nil {
+		utils.Log.WithError(err).Fatal("Error Querying Agent")
+	}
+	if *raw {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"status":   resp.Status,
+			"outbox":   resp.Outbox,
+			"queued":   resp.Queued,
+			"services": services.Services,
+		})
+		return
+	}
+
+	states := make(map[string]int)
+	for _, s := range services.Services {
+		states[s.State]++
+	}
+	fmt.Printf("version:      %s\n", resp.Status.Version)
+	fmt.Printf("uptime:       %s\n", time.Duration(resp.Status.Uptime)*time.Second)
+	if resp.Status.LastSync != nil {
+		fmt.Printf("last sync:    %s (%s ago)\n", resp.Status.LastSync.Format(time.RFC3339), time.Since(*resp.Status.LastSync).Round(time.Second))
+	} else {
+		fmt.Println("last sync:    never")
+	}
+	fmt.Printf("active users: %d\n", resp.Status.ActiveUsers)
+	fmt.Printf("inbounds:     %d\n", resp.Status.Inbounds)
+	fmt.Printf("services:     %d applied, %d failed, %d suspended\n", states["applied"], states["failed"], states["suspended"])
+	fmt.Printf("outbox:       %d users with unreported traffic\n", resp.Outbox)
+	fmt.Printf("queued:       %d stats, %d service batches\n", resp.Queued["stats"], resp.Queued["services"])
+	for _, c := range resp.Status.Components {
+		if !c.Healthy {
+			fmt.Printf("unhealthy:    %s, restarted %d times, last panic: %s\n", c.Name, c.Restarts, c.LastPanic)
+		}
+	}
+	if resp.Status.LastError != "" {
+		fmt.Printf("last error:   %s\n", resp.Status.LastError)
+	}
+	return
+}
+
+// adminGet call admin API of a running agent and decode response into out
+func adminGet(listen string, path string, out interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := "http://" + listen + path
+	if strings.HasPrefix(listen, "unix:") {
+		socket := strings.TrimPrefix(listen, "unix:")
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+		url = "http://rayagent" + path
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+modules.Config.GetString("admin.token"))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		return fmt.Errorf("admin API %s: Code %d: %s", path, res.StatusCode, body.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// register trade a bootstrap token for node credentials
+// usage: rayagent register --bootstrap-token TOKEN [--port 443]...
+func register(args []string) {
+	flags, config := newFlagSet("register")
+	bootstrapToken := flags.String("bootstrap-token", "", "one-time bootstrap token from raydash, default raydash.bootstraptoken")
+	ports := flags.UintSlice("port", nil, "ports this node serves, can be repeated")
+	force := flags.Bool("force", false, "register again even if credentials exist")
+	flags.Parse(args)
+	loadConfig(*config, "register")
+	if *bootstrapToken == "" {
+		*bootstrapToken = modules.Config.GetString("raydash.bootstraptoken")
+	}
+
+	creds, err := worker.Register(*bootstrapToken, *ports, *force)
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Registering Node")
+	}
+	utils.Log.WithField("nodeID", creds.NodeID).Info("Node Registered, Credentials Saved To " + modules.StatePath(modules.CredentialsFile))
+	return
+}
+
+// export write v2ray config of current backend state
+// usage: rayagent export [--output config.json] [--api 127.0.0.1:10085]
+func export(args []string) {
+	flags, config := newFlagSet("export")
+	output := flags.StringP("output", "o", "-", "file to write, - for stdout")
+	apiAddr := flags.String("api", "", "v2ray API address in exported config, default v2ray.grpcaddr")
+	flags.Parse(args)
+	loadConfig(*config, "export")
+	if *apiAddr == "" {
+		*apiAddr = modules.Config.GetString("v2ray.grpcaddr")
+	}
+	if *apiAddr == "" {
+		*apiAddr = "127.0.0.1:10085"
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Error Opening Output File")
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := worker.Export(w, *apiAddr); err != nil {
+		utils.Log.WithError(err).Fatal("Error Exporting Config")
+	}
+	return
+}
+
+// encrypt seal a secret for config, value is read from stdin to keep it out of shell history
+// usage: rayagent encrypt --key FILE [--genkey] < secret
+func encrypt(args []string) {
+	flags := pflag.NewFlagSet("encrypt", pflag.ExitOnError)
+	keyFile := flags.StringP("key", "k", "", "key file, same as secrets.keyfile in config")
+	genKey := flags.Bool("genkey", false, "create a new key file and exit")
+	flags.Parse(args)
+	if *keyFile == "" {
+		utils.Log.Fatal("Usage: rayagent encrypt --key FILE [--genkey] < secret")
+	}
+	if *genKey {
+		if err := modules.GenerateSecretKey(*keyFile); err != nil {
+			utils.Log.WithError(err).Fatal("Error Generating Secret Key")
+		}
+		fmt.Println("Secret key written to " + *keyFile)
+		return
+	}
+
+	key, err := modules.LoadSecretKey(*keyFile)
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Loading Secret Key")
+	}
+	plain, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Reading Secret")
+	}
+	sealed, err := modules.SealSecret(strings.TrimSpace(string(plain)), key)
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Encrypting Secret")
+	}
+	fmt.Println(sealed)
+	return
+}
+
+// importConfig move clients of a hand-managed v2ray config into RayDash
+// usage: rayagent import CONFIG --max-traffic BYTES [--output migration.json | --post] [--dry-run]
+func importConfig(args []string) {
+	flags, config := newFlagSet("import")
+	maxTraffic := flags.Uint64("max-traffic", 0, "traffic quota in bytes given to every imported user")
+	output := flags.StringP("output", "o", "migration.json", "migration file to write")
+	post := flags.Bool("post", false, "create users and services in RayDash instead of writing migration file")
+	dryRun := flags.Bool("dry-run", false, "only report what would be imported and conflicts")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		utils.Log.Fatal("Usage: rayagent import CONFIG --max-traffic BYTES [--output FILE | --post] [--dry-run]")
+	}
+	if *maxTraffic == 0 {
+		utils.Log.Fatal("--max-traffic must be set, v2ray config has no quota to import")
+	}
+	loadConfig(*config, "import")
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Opening V2Ray Config")
+	}
+	migration, err := worker.ParseV2RayConfig(f, modules.Config.GetUint64("raydash.nodeID"), *maxTraffic)
+	f.Close()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Importing V2Ray Config")
+	}
+
+	// Compare with what backend already has
+	b, err := worker.NewBackend()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Creating Backend")
+	}
+	if err := migration.CheckConflicts(context.Background(), b); err != nil {
+		if *post {
+			utils.Log.WithError(err).Fatal("Error Checking Conflicts")
+		}
+		utils.Log.WithError(err).Warn("Error Checking Conflicts, Only Conflicts Within Config Are Reported")
+	}
+
+	switch {
+	case *dryRun:
+	case *post:
+		rd, ok := b.(*backend.RayDashBackend)
+		if !ok {
+			utils.Log.Fatal("--post needs raydash backend")
+		}
+		if err := migration.Post(context.Background(), rd.Client()); err != nil {
+			utils.Log.WithError(err).Error("Error Posting Migration")
+		}
 	default:
-		utils.Log.SetLevel(logrus.InfoLevel)
+		data, err := json.MarshalIndent(migration, "", "  ")
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Error Encoding Migration")
+		}
+		if err := ioutil.WriteFile(*output, append(data, '\n'), 0600); err != nil {
+			utils.Log.WithError(err).Fatal("Error Writing Migration File")
+		}
+		fmt.Println("Migration written to", *output)
+	}
+
+	fmt.Printf("%d users to import\n", len(migration.Users))
+	for _, skipped := range migration.Report.Skipped {
+		fmt.Println("skipped:", skipped)
+	}
+	for _, c := range migration.Report.Conflicts {
+		fmt.Printf("conflict: %s port %d: %s\n", c.Email, c.Port, c.Reason)
+	}
+	if len(migration.Report.Conflicts) != 0 {
+		os.Exit(1)
+	}
+	return
+}
+
+func setupLog() {
+	err := utils.ConfigureLog(utils.LogConfig{
+		Level:      modules.Config.GetString("log.level"),
+		Levels:     modules.Config.GetStringMapString("log.levels"),
+		Format:     modules.Config.GetString("log.format"),
+		File:       modules.Config.GetString("log.file"),
+		MaxSize:    modules.Config.GetInt("log.maxsize"),
+		MaxAge:     modules.Config.GetInt("log.maxage"),
+		MaxBackups: modules.Config.GetInt("log.maxbackups"),
+		HashEmails: modules.Config.GetBool("log.hashemails"),
+		HashSalt:   modules.Config.GetString("log.hashsalt"),
+	})
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Setting Up Log")
 	}
 
+	utils.SetNodeID(modules.NodeID())
+	return
 }
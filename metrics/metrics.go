@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+// PerUser enable per-user traffic series, off by default to keep cardinality low
+var PerUser bool
+
+// Registry hold every rayagent metric, plus go and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	userTraffic = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rayagent_user_traffic_bytes_total",
+		Help: "Traffic of a user counted by core, only exported if per-user metrics are enabled.",
+	}, []string{"user", "direction"})
+
+	inboundTraffic = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rayagent_inbound_traffic_bytes_total",
+		Help: "Traffic of an inbound counted by core.",
+	}, []string{"inbound", "direction"})
+
+	activeUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rayagent_active_users",
+		Help: "Users currently applied to core.",
+	})
+
+	inbounds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rayagent_inbounds",
+		Help: "Inbounds currently applied to core.",
+	})
+
+	applyOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rayagent_apply_operations_total",
+		Help: "Changes pushed to core, by operation and result.",
+	}, []string{"operation", "result"})
+
+	raydashDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rayagent_raydash_request_duration_seconds",
+		Help:    "Latency of RayDash API calls, every attempt counted.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	raydashErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rayagent_raydash_errors_total",
+		Help: "Failed RayDash API calls, every attempt counted.",
+	}, []string{"method", "endpoint"})
+
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rayagent_grpc_request_duration_seconds",
+		Help:    "Latency of gRPC calls to core API.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method"})
+
+	grpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rayagent_grpc_errors_total",
+		Help: "Failed gRPC calls to core API.",
+	}, []string{"method"})
+
+	lastSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rayagent_last_sync_timestamp_seconds",
+		Help: "Unix time services were last fetched from backend.",
+	})
+
+	lastReport = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rayagent_last_report_timestamp_seconds",
+		Help: "Unix time traffic was last reported to backend.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		userTraffic,
+		inboundTraffic,
+		activeUsers,
+		inbounds,
+		applyOps,
+		raydashDuration,
+		raydashErrors,
+		grpcDuration,
+		grpcErrors,
+		lastSync,
+		lastReport,
+	)
+}
+
+// Serve expose /metrics on listen in background
+func Serve(listen string) (*http.Server, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			utils.Log.WithError(err).Error("Metrics Exporter Stopped")
+		}
+	}()
+	return server, nil
+}
+
+// ChannelDepth export current length of a channel, read on every scrape
+func ChannelDepth(name string, length func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "rayagent_channel_depth",
+		Help:        "Items waiting in a worker channel.",
+		ConstLabels: prometheus.Labels{"channel": name},
+	}, func() float64 { return float64(length()) }))
+}
+
+// OutboxBacklog export number of users with traffic backend did not take yet
+func OutboxBacklog(length func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "rayagent_outbox_backlog",
+		Help: "Users with traffic waiting in outbox for backend to take it.",
+	}, func() float64 { return float64(length()) }))
+}
+
+// UserTraffic count traffic of a user, if per-user metrics are enabled
+func UserTraffic(email string, up uint64, down uint64) {
+	if !PerUser {
+		return
+	}
+	userTraffic.WithLabelValues(email, "uplink").Add(float64(up))
+	userTraffic.WithLabelValues(email, "downlink").Add(float64(down))
+}
+
+// InboundTraffic count traffic of an inbound
+func InboundTraffic(tag string, up uint64, down uint64) {
+	inboundTraffic.WithLabelValues(tag, "uplink").Add(float64(up))
+	inboundTraffic.WithLabelValues(tag, "downlink").Add(float64(down))
+}
+
+// Applied record users and inbounds currently applied to core
+func Applied(users int, n int) {
+	activeUsers.Set(float64(users))
+	inbounds.Set(float64(n))
+}
+
+// ApplyOp count a change pushed to core
+func ApplyOp(operation string, err error) {
+	applyOps.WithLabelValues(operation, result(err)).Inc()
+}
+
+// Synced record a successful fetch of services
+func Synced(t time.Time) {
+	lastSync.Set(float64(t.Unix()))
+}
+
+// Reported record a successful traffic report
+func Reported(t time.Time) {
+	lastReport.Set(float64(t.Unix()))
+}
+
+// ObserveRayDash record a RayDash API call, ids in path are folded to keep cardinality low
+func ObserveRayDash(method string, path string, elapsed time.Duration, err error) {
+	endpoint := endpointOf(path)
+	raydashDuration.WithLabelValues(method, endpoint).Observe(elapsed.Seconds())
+	if err != nil {
+		raydashErrors.WithLabelValues(method, endpoint).Inc()
+	}
+}
+
+// UnaryClientInterceptor time every gRPC call to core
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	grpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		grpcErrors.WithLabelValues(method).Inc()
+	}
+	return err
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// endpointOf turn /nodes/5/services?page=2 into /nodes/:id/services
+func endpointOf(path string) string {
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		if _, err := strconv.ParseUint(segments[i], 10, 64); err == nil {
+			segments[i] = ":id"
+		} else if i > 0 && segments[i-1] == "users" {
+			segments[i] = ":username"
+		}
+	}
+	return strings.Join(segments, "/")
+}
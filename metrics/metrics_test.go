@@ -0,0 +1,25 @@
+package metrics
+
+import "testing"
+
+func TestEndpointOf(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/nodes/5/services?page=2&limit=100", "/nodes/:id/services"},
+		{"/nodes/5/users", "/nodes/:id/users"},
+		{"/nodes/5/status", "/nodes/:id/status"},
+		{"/users/alice", "/users/:username"},
+		{"/users/42", "/users/:id"},
+		{"/nodes/register", "/nodes/register"},
+		{"/", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := endpointOf(tt.path); got != tt.want {
+				t.Errorf("endpointOf(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package models
 
+import "encoding/json"
+
 // Node is a struct of node info
 type Node struct {
 	Name           string `json:"name"`
@@ -17,6 +19,11 @@ type Node struct {
 type Settings struct {
 	Listen             string `json:"listen"`
 	Port               uint   `json:"port"`
+	Protocol           string `json:"protocol"` // vmess by default, vless needs xray
 	VmessSetting       `json:"vmessSettings"`
+	VlessSetting       `json:"vlessSettings"`
 	ShadowsocksSetting `json:"shadowsocksSettings"`
+	// Inbound is a raw v2ray json inbound object, used instead of settings above when set
+	// tag and users are filled in by rayagent, single inbound mode only
+	Inbound json.RawMessage `json:"inbound,omitempty"`
 }
@@ -0,0 +1,15 @@
+package models
+
+// HostFacts is what a node tells raydash about itself on registration
+type HostFacts struct {
+	Hostname  string   `json:"hostname"`
+	PublicIPs []string `json:"public_ips"`
+	Ports     []uint   `json:"ports"`
+	Version   string   `json:"version"`
+}
+
+// Credentials is what raydash gives back for a bootstrap token
+type Credentials struct {
+	NodeID uint64 `json:"node_id"`
+	Token  string `json:"token"`
+}
@@ -6,16 +6,19 @@ type Service struct {
 	ID        uint64    `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	ExpireAt  time.Time `json:"expire_at"` // zero if service never expires
 
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	UserID      uint64 `json:"uid"`
 	NodeID      uint64 `json:"nid"`
 
-	Host      string `json:"host"`
-	Port      uint   `json:"port"`
-	Protocol  string `json:"protocol"`
-	VmessUser `json:"vmessUser"`
+	Host            string `json:"host"`
+	Port            uint   `json:"port"`
+	Protocol        string `json:"protocol"`
+	VmessUser       `json:"vmessUser"`
+	VlessUser       `json:"vlessUser"`
+	ShadowsocksUser `json:"shadowsocksUser"`
 	VmessSetting
 	ShadowsocksSetting
 }
@@ -34,6 +37,22 @@ type VmessSetting struct {
 	allocate struct{}
 }
 
+// VlessUser is only supported by xray
+type VlessUser struct {
+	Flow string `json:"flow"` // e.g. xtls-rprx-direct
+}
+
+// ShadowsocksUser is the password of a shadowsocks service
+type ShadowsocksUser struct {
+	Method   string `json:"method"` // e.g. aes-256-gcm
+	Password string `json:"password"`
+}
+
+// VlessSetting is only supported by xray
+type VlessSetting struct {
+	Flow string `json:"flow"` // xtls-rprx-* enables XTLS on the inbound
+}
+
 type StreamSettings struct {
 	TransportProtocol string `json:"protocol"`
 }
@@ -1,6 +1,18 @@
 package models
 
+import "time"
+
 type Stats struct {
-	Email   string
-	Traffic uint64 // in byte
+	Email    string
+	Traffic  uint64 // in byte
+	Uplink   uint64 // in byte
+	Downlink uint64 // in byte
+}
+
+// Traffic is what a node reports to backend for a user
+type Traffic struct {
+	User     User      `json:"user"` // with accumulated CurrentTraffic
+	Uplink   uint64    `json:"uplink"`
+	Downlink uint64    `json:"downlink"`
+	Time     time.Time `json:"time"`
 }
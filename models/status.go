@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// NodeStatus is the runtime status a node reports to raydash on every heartbeat
+type NodeStatus struct {
+	Version        string     `json:"version"`
+	Uptime         uint64     `json:"uptime"` // in second
+	V2RayReachable bool       `json:"v2ray_reachable"`
+	V2RayStats     *SysStats  `json:"v2ray_stats,omitempty"`
+	ActiveUsers    uint64     `json:"active_users"`
+	Inbounds       uint64     `json:"inbounds"`
+	LastSync       *time.Time `json:"last_sync,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	// Components are workers run under supervision, unhealthy ones are being restarted
+	Components []ComponentStatus `json:"components,omitempty"`
+}
+
+// ComponentStatus is the health of a supervised worker
+type ComponentStatus struct {
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	Restarts    uint64     `json:"restarts"`
+	LastPanic   string     `json:"last_panic,omitempty"`
+	LastPanicAt *time.Time `json:"last_panic_at,omitempty"`
+}
+
+// SysStats is the runtime stats of v2ray process
+type SysStats struct {
+	NumGoroutine uint32 `json:"num_goroutine"`
+	NumGC        uint32 `json:"num_gc"`
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+	LiveObjects  uint64 `json:"live_objects"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+	Uptime       uint32 `json:"uptime"` // in second
+}
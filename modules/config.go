@@ -1,65 +1,248 @@
 package modules
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 
+	"github.com/coolray-dev/rayagent/models"
 	"github.com/coolray-dev/rayagent/utils"
-	"github.com/spf13/pflag"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-// Config is a viper instance
-// We use single viper instance in rayagent
-var Config *viper.Viper
+// Config is the config rayagent runs with, safe to read from any goroutine
+// a reload replaces it as a whole, readers see either old or new settings
+var Config = &Settings{}
+
+// Settings hold current viper instance, read it through getters
+type Settings struct {
+	current atomic.Value // *viper.Viper, never changed once stored
+}
 
 func init() {
-	Config = viper.New()
-	pflag.String("config", "config", "config file name")
-	pflag.Parse()
-	Config.BindPFlags(pflag.CommandLine)
-	if Config.IsSet("config") {
-		Config.SetConfigFile(Config.GetString("config"))
+	Config.current.Store(viper.New())
+}
+
+// Viper return current viper instance, it must not be changed
+func (s *Settings) Viper() *viper.Viper {
+	return s.current.Load().(*viper.Viper)
+}
+
+func (s *Settings) store(v *viper.Viper) {
+	s.current.Store(v)
+	return
+}
+
+// ConfigFileUsed return path of config file
+func (s *Settings) ConfigFileUsed() string { return s.Viper().ConfigFileUsed() }
+
+// IsSet report whether key is set
+func (s *Settings) IsSet(key string) bool { return s.Viper().IsSet(key) }
+
+// GetString return key as string
+func (s *Settings) GetString(key string) string { return s.Viper().GetString(key) }
+
+// GetBool return key as bool
+func (s *Settings) GetBool(key string) bool { return s.Viper().GetBool(key) }
+
+// GetInt return key as int
+func (s *Settings) GetInt(key string) int { return s.Viper().GetInt(key) }
+
+// GetUint return key as uint
+func (s *Settings) GetUint(key string) uint { return s.Viper().GetUint(key) }
+
+// GetUint64 return key as uint64
+func (s *Settings) GetUint64(key string) uint64 { return s.Viper().GetUint64(key) }
+
+// GetStringMapString return key as map of strings
+func (s *Settings) GetStringMapString(key string) map[string]string {
+	return s.Viper().GetStringMapString(key)
+}
+
+// NodeID return ID of this node in backend in use
+// panels other than RayDash number nodes their own way
+func NodeID() uint64 {
+	switch Config.GetString("backend.type") {
+	case "sspanel", "v2board":
+		return Config.GetUint64("backend.nodeID")
+	default:
+		return Config.GetUint64("raydash.nodeID")
+	}
+}
+
+// LoadConfig read config file and check keys command needs
+// file is searched in working directory and /etc/rayagent if path is empty
+func LoadConfig(path string, command string) error {
+	v := viper.New()
+	if path != "" {
+		v.SetConfigFile(path)
 	} else {
-		Config.SetConfigName("config")
-		Config.SetConfigType("yaml")
-		Config.AddConfigPath(utils.AbsPath(""))
-		Config.AddConfigPath("/etc/rayagent")
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+		v.AddConfigPath(utils.AbsPath(""))
+		v.AddConfigPath("/etc/rayagent")
 	}
-	Config.SetEnvPrefix("RAYAGENT")
-	Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	Config.AutomaticEnv()
+	v.SetEnvPrefix("RAYAGENT")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
 
-	if err := Config.ReadInConfig(); err != nil {
-		utils.Log.WithError(err).Fatal("Fatal Error Reading Config File")
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("Error Reading Config File: %w", err)
 	}
-	Config.WatchConfig()
+	setDefault(v)
+	if err := loadSecrets(v); err != nil {
+		return err
+	}
+	loadCredentials(v)
+	Config.store(v)
 
 	// Check if neccessary config is set
-	if err := checkConfig(); err != nil {
-		utils.Log.Fatal("Config Error")
+	if err := checkConfig(v, command); err != nil {
+		return err
+	}
+	if err := checkLogConfig(v); err != nil {
+		return err
 	}
-	setDefault()
+	return checkAdminConfig(v)
+}
+
+// loadCredentials fill nodeID and token from registration
+// if they are not set in config file or env
+// v may not be Config yet, so its own state directory is read
+func loadCredentials(v *viper.Viper) {
+	if v.IsSet("raydash.nodeID") {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(v.GetString("agent.statedir"), CredentialsFile))
+	if err != nil {
+		return
+	}
+	var creds models.Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return
+	}
+	v.Set("raydash.nodeID", creds.NodeID)
+	v.Set("raydash.token", creds.Token)
 	return
 }
 
-func checkConfig() error {
-	if !Config.IsSet("raydash.nodeID") {
-		utils.Log.Error("raydash nodeID not set")
-		return errors.New("raydash nodeID not set")
+func checkConfig(v *viper.Viper, command string) error {
+	// status only talks to a running agent through admin API
+	if command == "status" {
+		return nil
 	}
-	if !Config.IsSet("raydash.url") {
+	if command != "register" {
+		switch v.GetString("backend.type") {
+		// Standalone nodes need no panel
+		case "file":
+			if !v.IsSet("backend.path") {
+				utils.Log.Error("backend path not set")
+				return errors.New("backend path not set")
+			}
+			return checkV2RayConfig(v)
+		// Other panels
+		case "sspanel", "v2board":
+			for _, key := range []string{"backend.url", "backend.token", "backend.nodeID"} {
+				if !v.IsSet(key) {
+					utils.Log.Error(key + " not set")
+					return errors.New(key + " not set")
+				}
+			}
+			return checkV2RayConfig(v)
+		}
+	}
+	if !v.IsSet("raydash.url") {
 		utils.Log.Error("raydash URL not set")
 		return errors.New("raydash URL not set")
 	}
-	if !Config.IsSet("v2ray.grpcaddr") {
+	// Registration is how a node get its nodeID
+	if command == "register" {
+		return nil
+	}
+	if !v.IsSet("raydash.nodeID") {
+		utils.Log.Error("raydash nodeID not set, set it in config or run rayagent register")
+		return errors.New("raydash nodeID not set")
+	}
+	return checkV2RayConfig(v)
+}
+
+func checkV2RayConfig(v *viper.Viper) error {
+	// Embedded v2ray has no API to connect to
+	if v.GetString("v2ray.driver") == "embedded" {
+		if v.GetBool("v2ray.supervise") {
+			utils.Log.Error("v2ray.supervise can not be used with embedded driver")
+			return errors.New("v2ray.supervise can not be used with embedded driver")
+		}
+		return nil
+	}
+	if !v.IsSet("v2ray.grpcaddr") {
 		utils.Log.Error("v2ray gRPC address not set")
 		return errors.New("v2ray gRPC address not set")
 	}
 	return nil
 }
 
-func setDefault() {
-	Config.SetDefault("raydash.interval", 5)
-	Config.SetDefault("v2ray.inbound", "rayagent")
+func checkAdminConfig(v *viper.Viper) error {
+	// Admin API can kick users, never serve it without a token
+	if v.GetString("admin.listen") != "" && v.GetString("admin.token") == "" {
+		utils.Log.Error("admin token not set")
+		return errors.New("admin token not set")
+	}
+	return nil
+}
+
+func checkLogConfig(v *viper.Viper) error {
+	switch v.GetString("log.format") {
+	case "text", "json":
+	default:
+		utils.Log.Error("log format must be text or json")
+		return errors.New("log format must be text or json")
+	}
+	for component, level := range v.GetStringMapString("log.levels") {
+		if level == "" {
+			continue
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			utils.Log.Errorf("invalid log level of %s", component)
+			return fmt.Errorf("invalid log level of %s: %w", component, err)
+		}
+	}
+	// Without a salt anyone with a list of emails can tell who a pseudonym is
+	if v.GetBool("log.hashemails") && v.GetString("log.hashsalt") == "" {
+		utils.Log.Warn("log hashsalt not set, email pseudonyms can be guessed")
+	}
+	return nil
+}
+
+func setDefault(v *viper.Viper) {
+	v.SetDefault("log.format", "text")
+	v.SetDefault("log.maxsize", 100)
+	v.SetDefault("log.maxage", 7)
+	v.SetDefault("log.maxbackups", 5)
+	v.SetDefault("log.hashemails", false)
+	v.SetDefault("raydash.interval", 5)
+	v.SetDefault("raydash.nodeinterval", 60)
+	v.SetDefault("raydash.pagesize", 100)
+	v.SetDefault("raydash.retries", 2)
+	v.SetDefault("raydash.retryinterval", 1)
+	v.SetDefault("raydash.heartbeat", 30)
+	v.SetDefault("v2ray.inbound", "rayagent")
+	v.SetDefault("v2ray.driver", "v2ray")
+	v.SetDefault("v2ray.supervise", false)
+	v.SetDefault("v2ray.binary", "v2ray")
+	v.SetDefault("metrics.peruser", false)
+	v.SetDefault("agent.statedir", "/var/lib/rayagent")
+	v.SetDefault("agent.shutdowntimeout", 15)
+	v.SetDefault("agent.statsinterval", 10)
+	v.SetDefault("audit.maxsize", 100)
+	v.SetDefault("audit.maxage", 0)
+	v.SetDefault("health.maxsyncage", 120)
+	v.SetDefault("health.stalltimeout", 300)
+	v.SetDefault("backend.type", "raydash")
+	v.SetDefault("backend.localport", 10085)
 }
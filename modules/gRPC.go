@@ -1,24 +1,47 @@
 package modules
 
 import (
+	"context"
 	"time"
 
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
-func ConnectGRPC(address string, timeoutDuration time.Duration) (conn *grpc.ClientConn, err error) {
+// grpcLog is logger of calls to core API, its level is log.levels.grpc
+var grpcLog = utils.Logger("grpc")
+
+func ConnectGRPC(address string, timeoutDuration time.Duration, opts ...grpc.DialOption) (conn *grpc.ClientConn, err error) {
 	timeout := time.After(timeoutDuration)
 	tick := time.Tick(500 * time.Millisecond)
+	opts = append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithChainUnaryInterceptor(logUnaryClientInterceptor)}, opts...)
 
 	for {
 		select {
 		case <-timeout:
 			return
 		case <-tick:
-			conn, err = grpc.Dial(address, grpc.WithInsecure())
+			conn, err = grpc.Dial(address, opts...)
 			if err == nil {
 				return
 			}
 		}
 	}
 }
+
+// logUnaryClientInterceptor log every gRPC call to core at debug, failed ones at warn
+func logUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	entry := grpcLog.WithFields(logrus.Fields{
+		"method":  method,
+		"elapsed": time.Since(start).String(),
+	})
+	if err != nil {
+		entry.WithError(err).Warn("gRPC Call Failed")
+		return err
+	}
+	entry.Debug("gRPC Call")
+	return nil
+}
@@ -0,0 +1,134 @@
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// hotKeys are settings a running agent applies without restart, as are log.levels.*
+// and _file of a hot key, e.g. raydash.token_file
+var hotKeys = map[string]bool{
+	"log.level":             true,
+	"raydash.url":           true,
+	"raydash.token":         true,
+	"raydash.interval":      true,
+	"raydash.nodeinterval":  true,
+	"raydash.heartbeat":     true,
+	"agent.statsinterval":   true,
+	"agent.shutdowntimeout": true, // read on shutdown
+	"health.maxsyncage":     true,
+	"health.stalltimeout":   true,
+}
+
+// ReloadConfig read config file again and check it the way LoadConfig does
+// Config is only replaced if every changed setting can be applied live
+// changed settings are returned for caller to apply
+func ReloadConfig() ([]string, error) {
+	next := viper.New()
+	next.SetConfigFile(Config.ConfigFileUsed())
+	next.SetEnvPrefix("RAYAGENT")
+	next.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	next.AutomaticEnv()
+	if err := next.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Error Reading Config File: %w", err)
+	}
+	setDefault(next)
+	if err := loadSecrets(next); err != nil {
+		return nil, err
+	}
+	loadCredentials(next)
+	if err := checkConfig(next, "run"); err != nil {
+		return nil, err
+	}
+	if err := checkLogConfig(next); err != nil {
+		return nil, err
+	}
+	if err := checkAdminConfig(next); err != nil {
+		return nil, err
+	}
+
+	changed := changedKeys(Config.Viper(), next)
+	rejected := make([]string, 0)
+	for _, key := range changed {
+		if !hotKeys[strings.TrimSuffix(key, "_file")] && !strings.HasPrefix(key, "log.levels.") {
+			rejected = append(rejected, key)
+		}
+	}
+	if len(rejected) != 0 {
+		return nil, fmt.Errorf("%s can not be changed without restart, config not reloaded", strings.Join(rejected, ", "))
+	}
+	if len(changed) != 0 {
+		Config.store(next)
+	}
+	return changed, nil
+}
+
+// WatchConfig call onChange when config file is written
+// directory is watched instead of file, editors and config management often replace the file
+func WatchConfig(onChange func()) (*fsnotify.Watcher, error) {
+	path, err := filepath.Abs(Config.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		// An editor save is several events, reload once they settle
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(500*time.Millisecond, onChange)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				utils.Log.WithError(err).Warn("Error Watching Config File")
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// changedKeys list settings with different values in a and b
+func changedKeys(a *viper.Viper, b *viper.Viper) []string {
+	keys := make(map[string]bool)
+	for _, key := range a.AllKeys() {
+		keys[key] = true
+	}
+	for _, key := range b.AllKeys() {
+		keys[key] = true
+	}
+	changed := make([]string, 0)
+	for key := range keys {
+		if !reflect.DeepEqual(a.Get(key), b.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,146 @@
+package modules
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// SecretPrefix marks a config value sealed by rayagent encrypt
+const SecretPrefix = "nacl:"
+
+// secretKeys may also be read from a file named by KEY_file, e.g. raydash.token_file
+// any key ending in _file in config file works, these are listed so env vars do as well
+var secretKeys = []string{
+	"raydash.token",
+	"raydash.bootstraptoken",
+	"backend.token",
+	"admin.token",
+	"log.hashsalt",
+}
+
+// loadSecrets fill keys from their _file and decrypt sealed values
+// files are read again on every reload, so rotated secrets are picked up
+func loadSecrets(v *viper.Viper) error {
+	fileKeys := make(map[string]bool)
+	for _, key := range secretKeys {
+		fileKeys[key+"_file"] = true
+	}
+	for _, key := range v.AllKeys() {
+		if strings.HasSuffix(key, "_file") {
+			fileKeys[key] = true
+		}
+	}
+	for fileKey := range fileKeys {
+		path := v.GetString(fileKey)
+		if path == "" {
+			continue
+		}
+		key := strings.TrimSuffix(fileKey, "_file")
+		if v.GetString(key) != "" {
+			return fmt.Errorf("both %s and %s set", key, fileKey)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Error Reading %s: %w", fileKey, err)
+		}
+		// Secrets written with echo or by editors end with a newline
+		v.Set(key, strings.TrimSpace(string(data)))
+	}
+
+	keys := append(v.AllKeys(), secretKeys...)
+	var secretKey *[32]byte
+	for _, key := range keys {
+		value, ok := v.Get(key).(string)
+		if !ok || !strings.HasPrefix(value, SecretPrefix) {
+			continue
+		}
+		if secretKey == nil {
+			path := v.GetString("secrets.keyfile")
+			if path == "" {
+				return fmt.Errorf("%s is encrypted but secrets keyfile not set", key)
+			}
+			var err error
+			if secretKey, err = LoadSecretKey(path); err != nil {
+				return err
+			}
+		}
+		plain, err := OpenSecret(value, secretKey)
+		if err != nil {
+			return fmt.Errorf("Error Decrypting %s: %w", key, err)
+		}
+		v.Set(key, plain)
+	}
+	return nil
+}
+
+// LoadSecretKey read a key file made by GenerateSecretKey
+func LoadSecretKey(path string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error Reading Secret Key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Error Decoding Secret Key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, errors.New("secret key must be 32 bytes")
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// GenerateSecretKey write a new random key to path, an existing file is never overwritten
+// values sealed with a lost key can not be recovered
+func GenerateSecretKey(path string) error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Error Creating Secret Key: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key[:]) + "\n"); err != nil {
+		return fmt.Errorf("Error Writing Secret Key: %w", err)
+	}
+	return nil
+}
+
+// SealSecret encrypt plain with NaCl secretbox, result can be pasted into config
+func SealSecret(plain string, key *[32]byte) (string, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	box := secretbox.Seal(nonce[:], []byte(plain), &nonce, key)
+	return SecretPrefix + base64.StdEncoding.EncodeToString(box), nil
+}
+
+// OpenSecret decrypt a value sealed by SealSecret
+func OpenSecret(sealed string, key *[32]byte) (string, error) {
+	box, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, SecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(box) < 24+secretbox.Overhead {
+		return "", errors.New("sealed value too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	plain, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return "", errors.New("wrong key or corrupted value")
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,164 @@
+package modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func testKey(b byte) *[32]byte {
+	var key [32]byte
+	for i := range key {
+		key[i] = b
+	}
+	return &key
+}
+
+func TestSealOpenSecret(t *testing.T) {
+	key := testKey(1)
+	sealed, err := SealSecret("s3cret", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, SecretPrefix) || strings.Contains(sealed, "s3cret") {
+		t.Fatalf("SealSecret() = %q", sealed)
+	}
+	if again, _ := SealSecret("s3cret", key); again == sealed {
+		t.Error("sealing twice gives same value, nonce is not random")
+	}
+
+	tests := []struct {
+		name    string
+		sealed  string
+		key     *[32]byte
+		want    string
+		wantErr bool
+	}{
+		{"round trip", sealed, key, "s3cret", false},
+		{"prefix is optional", strings.TrimPrefix(sealed, SecretPrefix), key, "s3cret", false},
+		{"wrong key", sealed, testKey(2), "", true},
+		{"not base64", SecretPrefix + "!!!", key, "", true},
+		{"too short", SecretPrefix + "AAAA", key, "", true},
+		{"corrupted", sealed[:len(sealed)-4] + "AAAA", key, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OpenSecret(tt.sealed, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OpenSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("OpenSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rayagent-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	keyFile := filepath.Join(dir, "secret.key")
+	if err := GenerateSecretKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadSecretKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealSecret("sealed-token", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := write("token", "file-token\n")
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		key      string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "plain value is kept",
+			settings: map[string]interface{}{"raydash.token": "plain-token"},
+			key:      "raydash.token",
+			want:     "plain-token",
+		},
+		{
+			name:     "value is read from file without trailing newline",
+			settings: map[string]interface{}{"raydash.token_file": tokenFile},
+			key:      "raydash.token",
+			want:     "file-token",
+		},
+		{
+			name:     "any key ending in _file is read",
+			settings: map[string]interface{}{"backend.apikey_file": tokenFile},
+			key:      "backend.apikey",
+			want:     "file-token",
+		},
+		{
+			name:     "value and file both set",
+			settings: map[string]interface{}{"raydash.token": "plain-token", "raydash.token_file": tokenFile},
+			wantErr:  true,
+		},
+		{
+			name:     "missing file",
+			settings: map[string]interface{}{"raydash.token_file": filepath.Join(dir, "missing")},
+			wantErr:  true,
+		},
+		{
+			name:     "sealed value is decrypted",
+			settings: map[string]interface{}{"raydash.token": sealed, "secrets.keyfile": keyFile},
+			key:      "raydash.token",
+			want:     "sealed-token",
+		},
+		{
+			name:     "sealed value read from file is decrypted",
+			settings: map[string]interface{}{"admin.token_file": write("sealed", sealed+"\n"), "secrets.keyfile": keyFile},
+			key:      "admin.token",
+			want:     "sealed-token",
+		},
+		{
+			name:     "sealed value without keyfile",
+			settings: map[string]interface{}{"raydash.token": sealed},
+			wantErr:  true,
+		},
+		{
+			name:     "sealed value with another key",
+			settings: map[string]interface{}{"raydash.token": sealed, "secrets.keyfile": write("other.key", strings.Repeat("A", 43)+"=\n")},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for k, value := range tt.settings {
+				v.Set(k, value)
+			}
+			err := loadSecrets(v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSecrets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := v.GetString(tt.key); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package modules
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// CredentialsFile is where node credentials from registration are kept
+const CredentialsFile = "credentials.json"
+
+// StatePath return path of a file in local state directory
+func StatePath(name string) string {
+	return filepath.Join(Config.GetString("agent.statedir"), name)
+}
+
+// LoadCredentials read node credentials saved by registration
+func LoadCredentials() (*models.Credentials, error) {
+	var c models.Credentials
+	if err := ReadState(CredentialsFile, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// SaveCredentials persist node credentials to local state directory
+func SaveCredentials(c *models.Credentials) error {
+	return WriteState(CredentialsFile, c)
+}
+
+// ReadState unmarshal a json file in local state directory
+func ReadState(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(StatePath(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteState marshal v into a json file in local state directory
+// the file is replaced atomically and only readable by owner since it may hold tokens
+func WriteState(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Config.GetString("agent.statedir"), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(Config.GetString("agent.statedir"), name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), StatePath(name))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/coolray-dev/rayagent/models"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
 	statsservice "v2ray.com/core/app/stats/command"
@@ -21,16 +22,38 @@ func NewStatsServiceClient(client *grpc.ClientConn) *StatsServiceClient {
 }
 
 func (s *StatsServiceClient) GetUserTraffic(email string) (uint64, error) {
-	up, err := s.getUserUplink(email)
+	up, down, err := s.GetUserUplinkDownlink(email)
 	if err != nil {
 		return 0, err
 	}
+	return up + down, nil
+
+}
+
+// GetUserUplinkDownlink return and reset uplink and downlink traffic of a user
+func (s *StatsServiceClient) GetUserUplinkDownlink(email string) (uint64, uint64, error) {
+	up, err := s.getUserUplink(email)
+	if err != nil {
+		return 0, 0, err
+	}
 	down, err2 := s.getUserDownlink(email)
 	if err2 != nil {
-		return 0, err2
+		return 0, 0, err2
 	}
-	return up + down, nil
+	return up, down, nil
+}
 
+// GetInboundUplinkDownlink return and reset uplink and downlink traffic of an inbound
+func (s *StatsServiceClient) GetInboundUplinkDownlink(tag string) (uint64, uint64, error) {
+	up, err := s.getUserStats(fmt.Sprintf("inbound>>>%s>>>traffic>>>uplink", tag), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	down, err := s.getUserStats(fmt.Sprintf("inbound>>>%s>>>traffic>>>downlink", tag), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	return up, down, nil
 }
 
 func (s *StatsServiceClient) getUserUplink(email string) (uint64, error) {
@@ -58,3 +81,23 @@ func (s *StatsServiceClient) getUserStats(name string, reset bool) (uint64, erro
 
 	return uint64(res.Stat.Value), nil
 }
+
+// GetSysStats return runtime stats of v2ray, also used to check if v2ray is reachable
+func (s *StatsServiceClient) GetSysStats() (*models.SysStats, error) {
+	res, err := s.StatsServiceClient.GetSysStats(context.Background(), &statsservice.SysStatsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &models.SysStats{
+		NumGoroutine: res.NumGoroutine,
+		NumGC:        res.NumGC,
+		Alloc:        res.Alloc,
+		TotalAlloc:   res.TotalAlloc,
+		Sys:          res.Sys,
+		Mallocs:      res.Mallocs,
+		Frees:        res.Frees,
+		LiveObjects:  res.LiveObjects,
+		PauseTotalNs: res.PauseTotalNs,
+		Uptime:       res.Uptime,
+	}, nil
+}
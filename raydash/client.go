@@ -0,0 +1,165 @@
+package raydash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Network Const
+const (
+	MaxIdleConns        int = 10
+	MaxIdleConnsPerHost int = 10
+	IdleConnTimeout     int = 90
+)
+
+// Client is a typed client of RayDash API
+// All requests share the same auth and retry policy
+type Client struct {
+	URL           string        // e.g. https://raydash.example.com
+	Token         string        // node token, sent as "Bearer node.<token>"
+	tokenType     string        // "node", or "bootstrap" before registration
+	PageSize      uint64        // items per page of listing endpoints
+	Retries       int           // extra attempts after a failed call
+	RetryInterval time.Duration // wait between attempts
+	// Observer is called after every attempt, e.g. to export latency
+	Observer   func(method string, path string, elapsed time.Duration, err error)
+	httpClient *http.Client
+	lock       sync.RWMutex // guards URL, Token and revision once client is in use
+	revision   string       // of services last listed
+}
+
+// NewClient return a RayDash client with default retry policy
+func NewClient(url string, token string) *Client {
+	return &Client{
+		URL:           url,
+		Token:         token,
+		tokenType:     "node",
+		PageSize:      100,
+		Retries:       2,
+		RetryInterval: time.Second,
+		httpClient:    createHTTPClient(),
+	}
+}
+
+// NewBootstrapClient return a RayDash client authenticating with a one-time bootstrap token
+// it is only good for registering a node
+func NewBootstrapClient(url string, bootstrapToken string) *Client {
+	c := NewClient(url, bootstrapToken)
+	c.tokenType = "bootstrap"
+	return c
+}
+
+// SetCredentials swap URL and token of a client in use
+// requests in flight finish with the old ones
+func (c *Client) SetCredentials(url string, token string) {
+	c.lock.Lock()
+	c.URL = url
+	c.Token = token
+	c.lock.Unlock()
+	return
+}
+
+// createHTTPClient for connection re-use
+func createHTTPClient() *http.Client {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        MaxIdleConns,
+			MaxIdleConnsPerHost: MaxIdleConnsPerHost,
+			IdleConnTimeout:     time.Duration(IdleConnTimeout) * time.Second,
+		},
+		Timeout: 30 * time.Second,
+	}
+	return client
+}
+
+// do send a request and hand the response body to decode
+// idempotent requests are retried on network errors and retryable status codes, others only if they surely were not applied
+// the body is always drained and closed
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, decode func(body io.Reader) error) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		payload, err = json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("Error Marshalling Request: %w", err)
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.RetryInterval):
+			}
+		}
+		start := time.Now()
+		err = c.doOnce(ctx, method, path, payload, decode)
+		if c.Observer != nil {
+			c.Observer(method, path, time.Since(start), err)
+		}
+		if !isRetryable(method, err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) doOnce(ctx context.Context, method string, path string, payload []byte, decode func(body io.Reader) error) error {
+
+	// Generate Request
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	c.lock.RLock()
+	url, token := c.URL, c.Token
+	c.lock.RUnlock()
+	req, err := http.NewRequestWithContext(ctx, method, url+path, body)
+	if err != nil {
+		return fmt.Errorf("Error Generating Request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.tokenType+"."+token)
+
+	// Call API
+	response, err := c.httpClient.Do(req)
+	if err != nil {
+		return &NetworkError{Method: method, Path: path, Err: err}
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	}()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return newAPIError(method, path, response)
+	}
+	if decode == nil {
+		return nil
+	}
+	if err := decode(response.Body); err != nil {
+		return fmt.Errorf("Error Parsing RayDash API Response: %w", err)
+	}
+	return nil
+}
+
+// decodeJSON return a decode func binding response into out
+func decodeJSON(out interface{}) func(body io.Reader) error {
+	return func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(out)
+	}
+}
@@ -0,0 +1,114 @@
+package raydash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// APIError is returned when RayDash answers with a non 2xx status
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string // error message from RayDash, if any
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("RayDash API %s %s: Code %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("RayDash API %s %s: Code %d", e.Method, e.Path, e.StatusCode)
+}
+
+// Temporary report whether the call may succeed if retried
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// NetworkError is returned when RayDash cannot be reached at all
+type NetworkError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("Error Calling RayDash API %s %s: %s", e.Method, e.Path, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// IsNotFound report whether err is a 404 from RayDash
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsUnauthorized report whether RayDash rejected the token
+func IsUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+// IsConflict report whether RayDash rejected a create because the object exists
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// isRetryable report whether a call of method that failed with err may be sent again
+// POST and PATCH are only retried if RayDash surely did not apply them,
+// a 502 or a dropped connection may come after traffic was already counted
+func isRetryable(method string, err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr *NetworkError
+	if errors.As(err, &netErr) {
+		return idempotent(method) || notSent(netErr.Err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	// 429 is refused before it is handled
+	return apiErr.StatusCode == http.StatusTooManyRequests || (apiErr.Temporary() && idempotent(method))
+}
+
+// idempotent report whether sending a request of method twice does no more than sending it once
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// notSent report whether err happened before request left, e.g. connection refused or DNS failure
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func newAPIError(method string, path string, response *http.Response) *APIError {
+	apiErr := &APIError{
+		Method:     method,
+		Path:       path,
+		StatusCode: response.StatusCode,
+	}
+
+	// RayDash reports errors as {"error": "..."}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 4096)).Decode(&body); err == nil {
+		apiErr.Message = body.Error
+	}
+	return apiErr
+}
@@ -0,0 +1,88 @@
+package raydash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// GetNode retrieve node info from /nodes/:id
+func (c *Client) GetNode(ctx context.Context, nodeID uint64) (*models.Node, error) {
+	var resp struct {
+		Node models.Node `json:"node"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%d", nodeID), nil, decodeJSON(&resp)); err != nil {
+		return nil, err
+	}
+	return &resp.Node, nil
+}
+
+// ListServices retrieve every page of /nodes/:id/services
+func (c *Client) ListServices(ctx context.Context, nodeID uint64) ([]models.Service, error) {
+	services := make([]models.Service, 0)
+	revision, err := c.fetchPages(ctx, fmt.Sprintf("/nodes/%d/services", nodeID), "services", func(dec *json.Decoder) error {
+		var s models.Service
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+		services = append(services, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.revision = revision
+	c.lock.Unlock()
+	return services, nil
+}
+
+// ListUsers retrieve every page of /nodes/:id/users
+func (c *Client) ListUsers(ctx context.Context, nodeID uint64) ([]models.User, error) {
+	users := make([]models.User, 0)
+	_, err := c.fetchPages(ctx, fmt.Sprintf("/nodes/%d/users", nodeID), "users", func(dec *json.Decoder) error {
+		var u models.User
+		if err := dec.Decode(&u); err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Revision return revision of services last listed, empty if RayDash sent none
+func (c *Client) Revision() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.revision
+}
+
+// CreateService create a service of node on /nodes/:id/services
+func (c *Client) CreateService(ctx context.Context, nodeID uint64, s *models.Service) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/nodes/%d/services", nodeID), s, nil)
+}
+
+// ReportNodeStatus post runtime status to /nodes/:id/status
+func (c *Client) ReportNodeStatus(ctx context.Context, nodeID uint64, status *models.NodeStatus) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/nodes/%d/status", nodeID), status, nil)
+}
+
+// RegisterNode trade host facts for node credentials on /nodes/register
+// the client must be created with NewBootstrapClient
+func (c *Client) RegisterNode(ctx context.Context, facts *models.HostFacts) (*models.Credentials, error) {
+	var creds models.Credentials
+	if err := c.do(ctx, http.MethodPost, "/nodes/register", facts, decodeJSON(&creds)); err != nil {
+		return nil, err
+	}
+	if creds.NodeID == 0 || creds.Token == "" {
+		return nil, fmt.Errorf("RayDash returned incomplete credentials")
+	}
+	return &creds, nil
+}
@@ -0,0 +1,175 @@
+package raydash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// page is the position of a paginated RayDash listing
+// RayDash either pages by number, in which case total is set,
+// or by cursor, in which case next is set on every page but the last
+type page struct {
+	Number uint64
+	Cursor string
+	Limit  uint64
+}
+
+// maxPages stop a listing RayDash never ends, e.g. when it ignores cursor
+const maxPages = 10000
+
+// pageInfo is what a single page tells us about the whole listing
+type pageInfo struct {
+	Total    uint64
+	Next     string
+	Count    uint64
+	Revision string // version of listed data, if RayDash sends one
+}
+
+// fetchPages walks every page of a listing endpoint and return revision of first page
+// key is the json field holding the array, each is called once per element
+// with the decoder positioned at that element, so no page is ever held in memory as a whole
+// a cursor seen before or more than maxPages pages is an error, listing would never end
+func (c *Client) fetchPages(ctx context.Context, path string, key string, each func(dec *json.Decoder) error) (string, error) {
+	p := page{Number: 1, Limit: c.PageSize}
+	var fetched uint64
+	var revision string
+	cursors := make(map[string]bool)
+	for pages := 1; ; pages++ {
+		if pages > maxPages {
+			return "", fmt.Errorf("%s has more than %d pages", path, maxPages)
+		}
+		info, err := c.fetchPage(ctx, path, p, key, each)
+		if err != nil {
+			return "", err
+		}
+		fetched += info.Count
+		if revision == "" {
+			revision = info.Revision
+		}
+
+		// Cursor pagination
+		if info.Next != "" {
+			if cursors[info.Next] {
+				return "", fmt.Errorf("%s repeated cursor %q at page %d", path, info.Next, pages)
+			}
+			cursors[info.Next] = true
+			p.Cursor = info.Next
+			continue
+		}
+		if p.Cursor != "" {
+			return revision, nil
+		}
+
+		// Page number pagination
+		// A page larger than limit means RayDash ignored pagination and sent everything
+		if info.Count == 0 || info.Count != p.Limit || (info.Total != 0 && fetched >= info.Total) {
+			return revision, nil
+		}
+		p.Number++
+	}
+}
+
+func (c *Client) fetchPage(ctx context.Context, path string, p page, key string, each func(dec *json.Decoder) error) (*pageInfo, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.FormatUint(p.Limit, 10))
+	if p.Cursor != "" {
+		query.Set("cursor", p.Cursor)
+	} else {
+		query.Set("page", strconv.FormatUint(p.Number, 10))
+	}
+
+	// Retries only happen before the body is read, so each never sees an element twice
+	var info *pageInfo
+	err := c.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, func(body io.Reader) error {
+		var err error
+		info, err = decodePage(json.NewDecoder(body), key, each)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// decodePage reads a page object token by token
+// fields other than key, total and next are skipped
+func decodePage(dec *json.Decoder, key string, each func(dec *json.Decoder) error) (*pageInfo, error) {
+	var info pageInfo
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		field, _ := t.(string)
+		switch field {
+		case key:
+			t, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil { // null, an empty page
+				continue
+			}
+			if delim, ok := t.(json.Delim); !ok || delim != '[' {
+				return nil, fmt.Errorf("expected [, got %v", t)
+			}
+			for dec.More() {
+				if err := each(dec); err != nil {
+					return nil, err
+				}
+				info.Count++
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return nil, err
+			}
+		case "total":
+			if err := dec.Decode(&info.Total); err != nil {
+				return nil, err
+			}
+		case "revision":
+			// A number or a string, kept as text
+			var revision json.RawMessage
+			if err := dec.Decode(&revision); err != nil {
+				return nil, err
+			}
+			info.Revision = strings.Trim(string(revision), `"`)
+		case "next", "next_cursor":
+			var next *string
+			if err := dec.Decode(&next); err != nil {
+				return nil, err
+			}
+			if next != nil {
+				info.Next = *next
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != d {
+		return fmt.Errorf("expected %s, got %v", d, t)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package raydash
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// PatchUser update user traffic on /users/:username
+func (c *Client) PatchUser(ctx context.Context, u *models.User) error {
+	return c.do(ctx, http.MethodPatch, "/users/"+url.PathEscape(u.Username), u, nil)
+}
+
+// CreateUser create a user on /users
+func (c *Client) CreateUser(ctx context.Context, u *models.User) error {
+	return c.do(ctx, http.MethodPost, "/users", u, nil)
+}
@@ -0,0 +1,82 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// APITag is the tag of API inbound and outbound in generated config
+const APITag = "api"
+
+// BaseConfig generate v2ray json config rayagent needs to manage v2ray:
+// an API inbound on apiAddr routed to the API, stats and policy counting every user,
+// and a freedom outbound. Inbounds serving users are added later through the API
+func BaseConfig(apiAddr string) (map[string]interface{}, error) {
+	host, portStr, err := net.SplitHostPort(apiAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v2ray API address %s: %w", apiAddr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v2ray API port %s: %w", portStr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	return map[string]interface{}{
+		"log": map[string]interface{}{
+			"loglevel": "warning",
+		},
+		"api": map[string]interface{}{
+			"tag":      APITag,
+			"services": []string{"HandlerService", "StatsService"},
+		},
+		"stats": map[string]interface{}{},
+		"policy": map[string]interface{}{
+			"levels": map[string]interface{}{
+				"0": map[string]interface{}{
+					"statsUserUplink":   true,
+					"statsUserDownlink": true,
+				},
+			},
+			"system": map[string]interface{}{
+				"statsInboundUplink":   true,
+				"statsInboundDownlink": true,
+			},
+		},
+		"inbounds": []interface{}{
+			map[string]interface{}{
+				"tag":      APITag,
+				"listen":   host,
+				"port":     port,
+				"protocol": "dokodemo-door",
+				"settings": map[string]interface{}{
+					"address": host,
+				},
+			},
+		},
+		"outbounds": []interface{}{
+			map[string]interface{}{
+				"tag":      "direct",
+				"protocol": "freedom",
+			},
+		},
+		"routing": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{
+					"type":        "field",
+					"inboundTag":  []string{APITag},
+					"outboundTag": APITag,
+				},
+			},
+		},
+	}, nil
+}
+
+// MarshalConfig turn a generated config into indented json
+func MarshalConfig(config map[string]interface{}) ([]byte, error) {
+	return json.MarshalIndent(config, "", "  ")
+}
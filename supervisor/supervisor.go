@@ -0,0 +1,259 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Backoff Const
+const (
+	MinBackoff    = time.Second
+	MaxBackoff    = time.Minute
+	StableRuntime = time.Minute // a run longer than this resets backoff
+	StopTimeout   = 10 * time.Second
+)
+
+// Supervisor run v2ray as a child process, restart it with backoff when it dies
+// and tell rayagent to apply all state again after every restart
+type Supervisor struct {
+	Binary     string // v2ray or xray executable
+	ConfigPath string // where generated config is written
+	APIAddr    string // v2ray API address, also used to tell when v2ray is up
+	OnRestart  func() // called once v2ray is up again after a restart
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+	lock       sync.Mutex
+}
+
+// NewSupervisor return a supervisor of binary with API on apiAddr
+func NewSupervisor(binary string, configPath string, apiAddr string) *Supervisor {
+	return &Supervisor{
+		Binary:     binary,
+		ConfigPath: configPath,
+		APIAddr:    apiAddr,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start write base config, launch v2ray and wait until its API is reachable
+func (s *Supervisor) Start(timeout time.Duration) error {
+	config, err := BaseConfig(s.APIAddr)
+	if err != nil {
+		return err
+	}
+	data, err := MarshalConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.ConfigPath), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.ConfigPath, data, 0600); err != nil {
+		return err
+	}
+
+	if err := s.launch(); err != nil {
+		return err
+	}
+	if err := s.waitAPI(timeout); err != nil {
+		s.kill()
+		return err
+	}
+	go s.supervise()
+	utils.Log.WithField("pid", s.pid()).Info("V2Ray Started")
+	return nil
+}
+
+// Stop terminate v2ray and stop restarting it
+func (s *Supervisor) Stop() {
+	close(s.stop)
+	s.lock.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.lock.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(StopTimeout):
+			cmd.Process.Kill()
+		}
+	}
+	<-s.done
+	return
+}
+
+// supervise restart v2ray whenever it exits, until Stop
+func (s *Supervisor) supervise() {
+	defer close(s.done)
+	backoff := MinBackoff
+	for {
+		s.lock.Lock()
+		exited := s.exited
+		s.lock.Unlock()
+		startedAt := time.Now()
+
+		select {
+		case <-s.stop:
+			<-exited
+			return
+		case <-exited:
+		}
+		s.lock.Lock()
+		state := s.cmd.ProcessState.String()
+		s.lock.Unlock()
+		utils.Log.WithField("state", state).Error("V2Ray Exited")
+
+		if time.Since(startedAt) > StableRuntime {
+			backoff = MinBackoff
+		}
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+
+			if err := s.launch(); err != nil {
+				utils.Log.WithError(err).Error("Error Restarting V2Ray")
+				continue
+			}
+			// Stop may have signalled the process this one replaced, then nobody stops it but us
+			select {
+			case <-s.stop:
+				s.kill()
+				return
+			default:
+			}
+			if err := s.waitAPI(10 * time.Second); err != nil {
+				// A core left running would hold API and inbound ports against the next one
+				utils.Log.WithError(err).Error("V2Ray API Unreachable After Restart")
+				s.kill()
+				continue
+			}
+			break
+		}
+		utils.Log.WithField("pid", s.pid()).Warn("V2Ray Restarted, Applying State Again")
+		if s.OnRestart != nil {
+			s.OnRestart()
+		}
+	}
+}
+
+// launch start a v2ray process with its output going to log
+func (s *Supervisor) launch() error {
+	cmd := exec.Command(s.Binary, "-config", s.ConfigPath)
+	cmd.Stdin = nil
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go s.capture(stdout, logrus.InfoLevel, &pipes)
+	go s.capture(stderr, logrus.WarnLevel, &pipes)
+	go func() {
+		pipes.Wait() // Wait must not be called before pipes are drained
+		cmd.Wait()
+		close(exited)
+	}()
+
+	s.lock.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.lock.Unlock()
+	return nil
+}
+
+// kill current v2ray process and wait until it is reaped
+func (s *Supervisor) kill() {
+	s.lock.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.lock.Unlock()
+	if cmd == nil || cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+	<-exited
+	return
+}
+
+// pid return pid of current v2ray process
+func (s *Supervisor) pid() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cmd.Process.Pid
+}
+
+// capture log every line v2ray prints
+func (s *Supervisor) capture(r io.Reader, level logrus.Level, pipes *sync.WaitGroup) {
+	defer pipes.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		utils.Log.WithField("component", "v2ray").Log(level, scanner.Text())
+	}
+}
+
+// waitAPI block until API port accepts connections or v2ray exits
+func (s *Supervisor) waitAPI(timeout time.Duration) error {
+	s.lock.Lock()
+	exited := s.exited
+	s.lock.Unlock()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return errors.New("v2ray exited before API is up")
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", s.APIAddr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return errors.New("timeout waiting for v2ray API")
+}
+
+// Running report whether v2ray process is alive
+func (s *Supervisor) Running() bool {
+	s.lock.Lock()
+	exited := s.exited
+	s.lock.Unlock()
+	if exited == nil {
+		return false
+	}
+	select {
+	case <-exited:
+		return false
+	default:
+		return true
+	}
+}
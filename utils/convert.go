@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"strconv"
+
 	"github.com/coolray-dev/rayagent/models"
 	"v2ray.com/core"
 	"v2ray.com/core/app/proxyman"
@@ -16,7 +18,7 @@ import (
 func ConvertVmessInbound(s *models.Service) *core.InboundHandlerConfig {
 	port, _ := net.PortFromInt(uint32(s.Port))
 	return &core.InboundHandlerConfig{
-		Tag: string(s.ID),
+		Tag: ServiceTag(s),
 		ReceiverSettings: serial.ToTypedMessage(
 			&proxyman.ReceiverConfig{
 				PortRange: net.SinglePortRange(port),
@@ -59,6 +61,11 @@ func ConvertVmessInbound(s *models.Service) *core.InboundHandlerConfig {
 	}
 }
 
+// ServiceTag is the inbound tag of a service in multi inbound mode
+func ServiceTag(s *models.Service) string {
+	return "service-" + strconv.FormatUint(s.ID, 10)
+}
+
 func ConvertService(s *models.Service) *protocol.User {
 	return &protocol.User{
 		Level: 0,
@@ -1,19 +1,187 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
 	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // Log is a public logger of whole project
+// lines logged through it belong to component "agent"
 var Log *logrus.Logger
 
+// LogConfig is how and where logs are written
+type LogConfig struct {
+	Level      string            // level of Log and components without their own
+	Levels     map[string]string // level of each component, e.g. poller: debug
+	Format     string            // text or json
+	File       string            // log file, stderr if empty
+	MaxSize    int               // megabytes of log file before it is rotated
+	MaxAge     int               // days rotated files are kept
+	MaxBackups int               // rotated files kept
+	HashEmails bool              // replace emails with pseudonyms
+	HashSalt   string            // key of pseudonyms, keep it secret and unchanged
+}
+
+var (
+	components     = make(map[string]*logrus.Logger)
+	componentLevel = make(map[string]bool) // components with a level of their own
+	componentsLock sync.Mutex
+	nodeID         uint64
+)
+
 func init() {
 	Log = logrus.New()
-	Log.SetFormatter(&logrus.TextFormatter{
+	Log.SetFormatter(&standardFormatter{Formatter: textFormatter()})
+	// Consider not to use Config here in case Config has not been initialized
+	// Also to avoid import circle
+}
+
+// Logger return logger of component, its level may differ from Log
+// every component shares output and format of Log
+func Logger(component string) *logrus.Entry {
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	l, found := components[component]
+	if !found {
+		l = logrus.New()
+		l.SetOutput(Log.Out)
+		l.SetFormatter(Log.Formatter)
+		l.SetLevel(Log.GetLevel())
+		components[component] = l
+	}
+	return l.WithField("component", component)
+}
+
+// ConfigureLog set up format, output and levels of every logger
+func ConfigureLog(c LogConfig) error {
+	var formatter logrus.Formatter
+	switch c.Format {
+	case "", "text":
+		formatter = textFormatter()
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %s", c.Format)
+	}
+	formatter = &standardFormatter{Formatter: formatter}
+
+	var out io.Writer = os.Stderr
+	if c.File != "" {
+		out = &lumberjack.Logger{
+			Filename:   c.File,
+			MaxSize:    c.MaxSize,
+			MaxAge:     c.MaxAge,
+			MaxBackups: c.MaxBackups,
+			LocalTime:  true,
+		}
+	}
+
+	componentsLock.Lock()
+	Log.SetFormatter(formatter)
+	Log.SetOutput(out)
+	for _, l := range components {
+		l.SetFormatter(formatter)
+		l.SetOutput(out)
+	}
+	componentsLock.Unlock()
+	HashEmails(c.HashEmails, c.HashSalt)
+	return SetLevels(c.Level, c.Levels)
+}
+
+// SetLevel set level of Log and every component without a level of its own
+// unknown names fall back to info
+func SetLevel(level string) {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		l = logrus.InfoLevel
+	}
+	componentsLock.Lock()
+	Log.SetLevel(l)
+	for name, logger := range components {
+		if !componentLevel[name] {
+			logger.SetLevel(l)
+		}
+	}
+	componentsLock.Unlock()
+	return
+}
+
+// SetLevels set default level and levels of components, components not in levels follow default
+func SetLevels(level string, levels map[string]string) error {
+	parsed := make(map[string]logrus.Level)
+	for name, l := range levels {
+		if l == "" {
+			continue
+		}
+		p, err := logrus.ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("invalid level of %s: %w", name, err)
+		}
+		parsed[name] = p
+	}
+
+	componentsLock.Lock()
+	componentLevel = make(map[string]bool)
+	for name := range parsed {
+		componentLevel[name] = true
+	}
+	componentsLock.Unlock()
+	SetLevel(level)
+
+	for name, l := range parsed {
+		Logger(name).Logger.SetLevel(l)
+	}
+	return nil
+}
+
+// SetNodeID set node_id field of every log line
+func SetNodeID(id uint64) {
+	atomic.StoreUint64(&nodeID, id)
+	return
+}
+
+// NewCycle return ID of a new sync cycle
+// workers log it in field cycle_id and pass it along with what the cycle fetched
+func NewCycle() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func textFormatter() logrus.Formatter {
+	return &logrus.TextFormatter{
 		FullTimestamp:          true,
 		DisableLevelTruncation: true,
 		PadLevelText:           true,
-	})
-	// Consider not to use Config here in case Config has not been initialized
-	// Also to avoid import circle
+	}
+}
+
+// standardFormatter add node_id and component to every line
+// and redact secrets, every logger formats through it
+// fields go into a copy, entries may be shared between goroutines
+type standardFormatter struct {
+	logrus.Formatter
+}
+
+func (f *standardFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(e.Data)+2)
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	if _, found := data["component"]; !found {
+		data["component"] = "agent"
+	}
+	data["node_id"] = atomic.LoadUint64(&nodeID)
+	entry := *e
+	entry.Data = data
+	redactEntry(&entry)
+	return f.Formatter.Format(&entry)
 }
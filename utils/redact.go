@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Authorization headers and request dumps, e.g. "Bearer node.abcd"
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	// Panel keys travel in query strings and show up in url.Error
+	secretParamPattern = regexp.MustCompile(`(?i)([?&](?:token|key|secret|password|access_token)=)[^&\s"']+`)
+	uuidPattern        = regexp.MustCompile(`\b([0-9a-fA-F]{8})-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`)
+	emailPattern       = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+	emailSalt atomic.Value // []byte, nil unless emails are hashed
+)
+
+func init() {
+	emailSalt.Store([]byte(nil))
+}
+
+// HashEmails replace emails in log lines with pseudonyms stable for the same salt
+// lines of one node can be correlated, emails can not be read back without salt
+func HashEmails(enable bool, salt string) {
+	if !enable {
+		emailSalt.Store([]byte(nil))
+		return
+	}
+	emailSalt.Store(append([]byte{}, salt...))
+	return
+}
+
+// Redact mask bearer tokens, secret query parameters and UUIDs in s
+// UUIDs keep their first group, enough to tell users apart while debugging
+func Redact(s string) string {
+	s = bearerPattern.ReplaceAllString(s, "${1}***")
+	s = secretParamPattern.ReplaceAllString(s, "${1}***")
+	s = uuidPattern.ReplaceAllString(s, "${1}-****-****-****-************")
+	if salt := emailSalt.Load().([]byte); salt != nil {
+		s = emailPattern.ReplaceAllStringFunc(s, func(email string) string {
+			return pseudonym(salt, email)
+		})
+	}
+	return s
+}
+
+// pseudonym of an email, case does not matter like in most mail systems
+func pseudonym(salt []byte, email string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(strings.ToLower(email)))
+	return "anon-" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// redactValue redact field values that may carry text, numbers and the like are kept
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return Redact(value)
+	case []string:
+		redacted := make([]string, len(value))
+		for i := range value {
+			redacted[i] = Redact(value[i])
+		}
+		return redacted
+	case time.Time:
+		return v
+	case error:
+		return Redact(value.Error())
+	case fmt.Stringer:
+		return Redact(value.String())
+	default:
+		return v
+	}
+}
+
+// redactEntry redact message and fields of e in place, e must be a copy
+func redactEntry(e *logrus.Entry) {
+	e.Message = Redact(e.Message)
+	for k, v := range e.Data {
+		e.Data[k] = redactValue(v)
+	}
+	return
+}
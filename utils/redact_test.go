@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bearer token", "Authorization: Bearer node.abcd-1234", "Authorization: Bearer ***"},
+		{"secret query parameter", `Get "https://panel/api?node_id=1&token=s3cret&x=1"`, `Get "https://panel/api?node_id=1&token=***&x=1"`},
+		{"query parameter case", "/api?Key=s3cret", "/api?Key=***"},
+		{"uuid keeps first group", "user 3b241101-e2bb-4255-8caf-4136c566a962 added", "user 3b241101-****-****-****-************ added"},
+		{"emails kept unless hashed", "user a@example.com added", "user a@example.com added"},
+		{"nothing to redact", "Inbounds Rebuilt", "Inbounds Rebuilt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.in); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactHashedEmails(t *testing.T) {
+	HashEmails(true, "salt")
+	defer HashEmails(false, "")
+
+	a := Redact("user a@example.com added")
+	if strings.Contains(a, "a@example.com") || !strings.Contains(a, "anon-") {
+		t.Errorf("email not hashed: %q", a)
+	}
+	if b := Redact("user A@Example.com added"); b != a {
+		t.Errorf("pseudonym depends on case: %q and %q", a, b)
+	}
+	if c := Redact("user c@example.com added"); c == a {
+		t.Errorf("different emails share a pseudonym: %q", c)
+	}
+
+	HashEmails(true, "other salt")
+	if d := Redact("user a@example.com added"); d == a {
+		t.Errorf("pseudonym does not depend on salt: %q", d)
+	}
+}
@@ -0,0 +1,5 @@
+package utils
+
+// Version of rayagent, set at build time by
+// go build -ldflags "-X github.com/coolray-dev/rayagent/utils.Version=v1.0.0"
+var Version = "dev"
@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coolray-dev/rayagent/audit"
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminServer is a local HTTP API to inspect and control a running rayagent
+// Listen is host:port, or unix:/path for a unix socket
+type AdminServer struct {
+	Listen string
+	Token  string
+	agent  *RayAgent
+	server *http.Server
+}
+
+// UserUsage is a user in pool with how much of its traffic is used
+type UserUsage struct {
+	Email          string  `json:"email"`
+	Username       string  `json:"username"`
+	CurrentTraffic uint64  `json:"current_traffic"`
+	MaxTraffic     uint64  `json:"max_traffic"`
+	Usage          float64 `json:"usage"` // CurrentTraffic / MaxTraffic
+}
+
+// NewAdminServer return an admin server of agent
+func NewAdminServer(r *RayAgent, listen string, token string) *AdminServer {
+	a := &AdminServer{
+		Listen: listen,
+		Token:  token,
+		agent:  r,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/node", a.handleNode)
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/users", a.handleUsers)
+	mux.HandleFunc("/users/", a.handleUserAction)
+	mux.HandleFunc("/services", a.handleServices)
+	mux.HandleFunc("/sync", a.handleSync)
+	mux.HandleFunc("/log/level", a.handleLogLevel)
+	mux.HandleFunc("/audit", a.handleAudit)
+	a.server = &http.Server{
+		Handler:      a.auth(mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: time.Minute,
+	}
+	return a
+}
+
+// Start listen and serve in background
+func (a *AdminServer) Start() error {
+	var l net.Listener
+	var err error
+	if strings.HasPrefix(a.Listen, "unix:") {
+		path := strings.TrimPrefix(a.Listen, "unix:")
+		os.Remove(path) // stale socket of last run
+		if l, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return err
+		}
+	} else if l, err = net.Listen("tcp", a.Listen); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := a.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			utils.Log.WithError(err).Error("Admin API Stopped")
+		}
+	}()
+	utils.Log.WithField("listen", a.Listen).Info("Admin API Started")
+	return nil
+}
+
+// Stop shut down server, waiting for requests in flight
+func (a *AdminServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.server.Shutdown(ctx)
+	return
+}
+
+// auth reject requests without admin token
+func (a *AdminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /node
+func (a *AdminServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	node := a.agent.servicePoller.Node()
+	if node == nil {
+		node = a.agent.nodeInfo
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":   nodeInfo.ID,
+		"node": node,
+	})
+}
+
+// GET /status
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": agentStatus.nodeStatus(),
+		"outbox": a.agent.statsSender.Pending(), // users with traffic backend did not take yet
+		"queued": map[string]int{
+			"stats":    len(a.agent.statsChannel), // samples waiting for StatsSender
+			"services": len(a.agent.schan),        // service batches waiting to be applied
+		},
+	})
+}
+
+// GET /users
+func (a *AdminServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	userPoolLock.RLock()
+	users := make([]UserUsage, 0, len(userPool))
+	for _, u := range userPool {
+		usage := UserUsage{
+			Email:          u.Email,
+			Username:       u.Username,
+			CurrentTraffic: u.CurrentTraffic,
+			MaxTraffic:     u.MaxTraffic,
+		}
+		if u.MaxTraffic != 0 {
+			usage.Usage = float64(u.CurrentTraffic) / float64(u.MaxTraffic)
+		}
+		users = append(users, usage)
+	}
+	userPoolLock.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"users": users})
+}
+
+// POST /users/:email/kick, /users/:email/suspend, /users/:email/resume
+func (a *AdminServer) handleUserAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/users/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		writeError(w, http.StatusNotFound, errors.New("usage: POST /users/:email/{kick,suspend,resume}"))
+		return
+	}
+	email, op := path[:i], path[i+1:]
+	if err := a.agent.serviceHandler.Control(op, email); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"email": email, "action": op})
+}
+
+// GET /services
+func (a *AdminServer) handleServices(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"services": a.agent.serviceHandler.States()})
+}
+
+// POST /sync
+func (a *AdminServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	a.agent.servicePoller.Sync()
+	writeJSON(w, http.StatusAccepted, map[string]string{"sync": "scheduled"})
+}
+
+// GET or PUT /log/level with {"level": "debug"}
+func (a *AdminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		level, err := logrus.ParseLevel(body.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		utils.SetLevel(level.String())
+		utils.Log.WithField("level", level.String()).Info("Log Level Changed By Admin")
+	default:
+		allowMethod(w, r, http.MethodGet, http.MethodPut)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": utils.Log.GetLevel().String()})
+}
+
+// GET /audit?email=&operation=&reason=&since=&until=&limit=
+// since and until are RFC 3339, newest limit entries are returned oldest first
+func (a *AdminServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if a.agent.audit == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("audit log not open"))
+		return
+	}
+	params := r.URL.Query()
+	q := audit.Query{
+		Email:     params.Get("email"),
+		Operation: params.Get("operation"),
+		Reason:    params.Get("reason"),
+	}
+	var err error
+	for key, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(key); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %w", key, err))
+				return
+			}
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %w", err))
+			return
+		}
+	}
+	entries, err := a.agent.audit.Query(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answer {"error": "..."}, the same way RayDash does
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"github.com/coolray-dev/rayagent/audit"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/utils"
+)
+
+// newAuditLogger open audit log set in config, in state directory by default
+func newAuditLogger() (*audit.Logger, error) {
+	path := modules.Config.GetString("audit.file")
+	if path == "" {
+		path = modules.StatePath("audit.jsonl")
+	}
+	return audit.NewLogger(path, modules.Config.GetInt("audit.maxsize"), modules.Config.GetInt("audit.maxage"))
+}
+
+// Changes to core go through these, so every one of them is audited with its reason
+
+// addUser add user of s to single inbound
+func (h *ServiceHandler) addUser(s *models.Service, reason string) error {
+	err := h.driver.AddUser(h.Tag, s)
+	h.record(audit.AddUser, h.Tag, s.Email, reason, err)
+	return err
+}
+
+// delUser remove user with email from single inbound
+func (h *ServiceHandler) delUser(email string, reason string) error {
+	err := h.driver.DelUser(h.Tag, email)
+	h.record(audit.DelUser, h.Tag, email, reason, err)
+	return err
+}
+
+// addServiceInbound add inbound of s in multi inbound mode
+func (h *ServiceHandler) addServiceInbound(s *models.Service, reason string) error {
+	tag := utils.ServiceTag(s)
+	err := h.driver.AddServiceInbound(tag, s)
+	h.record(audit.AddInbound, tag, s.Email, reason, err)
+	return err
+}
+
+// addNodeInbound add single inbound shared by every user
+func (h *ServiceHandler) addNodeInbound(reason string) error {
+	err := h.driver.AddNodeInbound(h.Tag, h.NodeInfo)
+	h.record(audit.AddInbound, h.Tag, "", reason, err)
+	return err
+}
+
+// removeInbound remove inbound with tag, email is its user in multi inbound mode
+func (h *ServiceHandler) removeInbound(tag string, email string, reason string) error {
+	err := h.driver.RemoveInbound(tag)
+	h.record(audit.RemoveInbound, tag, email, reason, err)
+	return err
+}
+
+func (h *ServiceHandler) record(op string, tag string, email string, reason string, err error) {
+	if h.Audit == nil {
+		return
+	}
+	e := audit.Entry{
+		NodeID:    nodeInfo.ID,
+		Operation: op,
+		Tag:       tag,
+		Email:     email,
+		Reason:    reason,
+		Result:    audit.ResultOK,
+		CycleID:   h.cycle,
+		Revision:  h.revision,
+	}
+	if err != nil {
+		e.Result, e.Error = audit.ResultError, err.Error()
+	}
+	if err := h.Audit.Record(e); err != nil {
+		h.log.WithError(err).Error("Error Writing Audit Log")
+	}
+	return
+}
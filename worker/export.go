@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coolray-dev/rayagent/driver"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/supervisor"
+)
+
+// exportTimeout limit time spent fetching backend state for export
+const exportTimeout = time.Minute
+
+// Export write a standalone v2ray config with every inbound and user rayagent would apply
+// for current backend state, API on apiAddr is kept so the config can be diffed against a running node
+func Export(w io.Writer, apiAddr string) error {
+	b, err := NewBackend()
+	if err != nil {
+		return err
+	}
+	if closer, ok := b.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	node, err := b.GetNode(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting NodeInfo: %w", err)
+	}
+	users, err := b.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting Users: %w", err)
+	}
+	services, err := b.ListServices(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting Services: %w", err)
+	}
+
+	// Users over their traffic are not applied in single inbound mode
+	if !node.HasMultiPort {
+		pool := make(map[string]*models.User)
+		for i := range users {
+			if err := modules.Validator.Struct(&users[i]); err != nil {
+				continue
+			}
+			pool[users[i].Email] = &users[i]
+		}
+		var applied []models.Service
+		for i := range services {
+			if u, found := pool[services[i].Email]; found && u.MaxTraffic >= u.CurrentTraffic {
+				applied = append(applied, services[i])
+			}
+		}
+		services = applied
+	}
+
+	inbounds, err := driver.ExportInbounds(modules.Config.GetString("v2ray.inbound"), node, services)
+	if err != nil {
+		return fmt.Errorf("Error Generating Inbounds: %w", err)
+	}
+	config, err := supervisor.BaseConfig(apiAddr)
+	if err != nil {
+		return err
+	}
+	config["inbounds"] = append(config["inbounds"].([]interface{}), inbounds...)
+	data, err := supervisor.MarshalConfig(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/models"
+)
+
+// fakeDriver is a core kept in memory, every change is recorded in ops
+// an op listed in fail returns its error, checks are listed as check_node PORT and check_service EMAIL
+type fakeDriver struct {
+	lock    sync.Mutex
+	ops     []string
+	fail    map[string]error
+	traffic map[string][2]uint64 // uplink and downlink by email
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{
+		fail:    make(map[string]error),
+		traffic: make(map[string][2]uint64),
+	}
+}
+
+func (d *fakeDriver) do(op string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.ops = append(d.ops, op)
+	return d.fail[op]
+}
+
+func (d *fakeDriver) CheckNode(node *models.Node) error {
+	return d.fail[fmt.Sprintf("check_node %d", node.Port)]
+}
+
+func (d *fakeDriver) AddNodeInbound(tag string, node *models.Node) error {
+	return d.do(fmt.Sprintf("add_inbound %s %d", tag, node.Port))
+}
+
+func (d *fakeDriver) CheckService(s *models.Service) error {
+	return d.fail["check_service "+s.Email]
+}
+
+func (d *fakeDriver) AddServiceInbound(tag string, s *models.Service) error {
+	return d.do("add_inbound " + tag)
+}
+
+func (d *fakeDriver) RemoveInbound(tag string) error {
+	return d.do("remove_inbound " + tag)
+}
+
+func (d *fakeDriver) AddUser(tag string, s *models.Service) error {
+	return d.do("add_user " + s.Email)
+}
+
+func (d *fakeDriver) DelUser(tag string, email string) error {
+	return d.do("del_user " + email)
+}
+
+func (d *fakeDriver) GetUserTraffic(email string) (uint64, uint64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	t := d.traffic[email]
+	delete(d.traffic, email)
+	return t[0], t[1], nil
+}
+
+func (d *fakeDriver) GetInboundTraffic(tag string) (uint64, uint64, error) {
+	return 0, 0, nil
+}
+
+func (d *fakeDriver) GetSysStats() (*models.SysStats, error) {
+	return &models.SysStats{}, nil
+}
+
+// fakeBackend serves users it holds and takes traffic once refusals run out
+type fakeBackend struct {
+	lock     sync.Mutex
+	users    []models.User
+	usersErr error
+	refusals int             // ReportTraffic calls refused before traffic is taken, -1 refuses all
+	unknown  map[string]bool // emails backend never takes traffic of
+	reported []models.Traffic
+}
+
+func (b *fakeBackend) GetNode(ctx context.Context) (*models.Node, error) {
+	return &models.Node{}, nil
+}
+
+func (b *fakeBackend) ListUsers(ctx context.Context) ([]models.User, error) {
+	if b.usersErr != nil {
+		return nil, b.usersErr
+	}
+	return append([]models.User(nil), b.users...), nil
+}
+
+func (b *fakeBackend) ListServices(ctx context.Context) ([]models.Service, error) {
+	return nil, nil
+}
+
+func (b *fakeBackend) ReportTraffic(ctx context.Context, traffic []models.Traffic) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.refusals != 0 {
+		if b.refusals > 0 {
+			b.refusals--
+		}
+		return fmt.Errorf("backend unavailable")
+	}
+	var left []models.Traffic
+	for _, t := range traffic {
+		if b.unknown[t.User.Email] {
+			left = append(left, t)
+			continue
+		}
+		b.reported = append(b.reported, t)
+	}
+	if len(left) != 0 {
+		return &backend.PartialReportError{Traffic: left, Err: fmt.Errorf("unknown users")}
+	}
+	return nil
+}
+
+// setUserPool replace users in shared pool
+func setUserPool(users ...models.User) {
+	userPoolLock.Lock()
+	defer userPoolLock.Unlock()
+	for email := range userPool {
+		delete(userPool, email)
+	}
+	for i := range users {
+		userPool[users[i].Email] = &users[i]
+	}
+}
+
+func testUser(email string, max uint64, current uint64) models.User {
+	return models.User{Email: email, Username: email, MaxTraffic: max, CurrentTraffic: current}
+}
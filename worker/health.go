@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/systemd"
+	"github.com/coolray-dev/rayagent/utils"
+	"google.golang.org/grpc/connectivity"
+)
+
+// HealthServer serve /healthz and /readyz for orchestration
+// it has no auth, only whether agent is alive and ready is exposed
+type HealthServer struct {
+	Listen string
+	agent  *RayAgent
+	server *http.Server
+}
+
+// NewHealthServer return a health server of agent
+func NewHealthServer(r *RayAgent, listen string) *HealthServer {
+	h := &HealthServer{
+		Listen: listen,
+		agent:  r,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+	h.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	return h
+}
+
+// Start listen and serve in background
+func (h *HealthServer) Start() error {
+	l, err := net.Listen("tcp", h.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := h.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			utils.Log.WithError(err).Error("Health Endpoints Stopped")
+		}
+	}()
+	utils.Log.WithField("listen", h.Listen).Info("Health Endpoints Started")
+	return nil
+}
+
+// Stop shut down server
+func (h *HealthServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.server.Shutdown(ctx)
+	return
+}
+
+// GET /healthz, process is alive
+func (h *HealthServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz, 503 until backend is synced, core is connected and services are applied
+func (h *HealthServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	checks, ready := h.agent.readiness()
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+// readiness check backend was reachable recently, core is connected, first sync is applied
+// and workers are running, every check is "ok" or why it failed
+func (r *RayAgent) readiness() (map[string]string, bool) {
+	checks := map[string]string{
+		"backend": "ok",
+		"core":    "ok",
+		"applied": "ok",
+		"workers": "ok",
+	}
+	lastSync, applied := agentStatus.readiness()
+	maxAge := time.Duration(modules.Config.GetUint64("health.maxsyncage")) * time.Second
+	if lastSync.IsZero() {
+		checks["backend"] = "never synced"
+	} else if age := time.Since(lastSync); age > maxAge {
+		checks["backend"] = fmt.Sprintf("last synced %s ago", age.Round(time.Second))
+	}
+	if !applied {
+		checks["applied"] = "first sync not applied yet"
+	}
+	if err := r.coreConnected(); err != nil {
+		checks["core"] = err.Error()
+	}
+	if stalled := r.stalled(); len(stalled) != 0 {
+		checks["workers"] = "stalled: " + strings.Join(stalled, ", ")
+	} else if !agentStatus.healthy() {
+		checks["workers"] = "restarting after panic"
+	}
+
+	for _, result := range checks {
+		if result != "ok" {
+			return checks, false
+		}
+	}
+	return checks, true
+}
+
+// coreConnected report whether gRPC connection to core is usable
+// an idle connection reconnects on next call, embedded core has no connection at all
+func (r *RayAgent) coreConnected() error {
+	if r.gRPCConn == nil {
+		return nil
+	}
+	switch state := r.gRPCConn.GetState(); state {
+	case connectivity.Ready, connectivity.Idle:
+		return nil
+	default:
+		return errors.New("gRPC connection " + strings.ToLower(state.String()))
+	}
+}
+
+// stalled list workers that have work to do but finished none within health.stalltimeout
+// ticker driven workers always have work, channel driven ones only while their channel is not empty
+func (r *RayAgent) stalled() []string {
+	timeout := time.Duration(modules.Config.GetUint64("health.stalltimeout")) * time.Second
+	stalled := make([]string, 0)
+	check := func(component string, busy bool, every time.Duration) {
+		last := agentStatus.lastBeat(component)
+		if last.IsZero() {
+			last = agentStatus.startedAt
+		}
+		if busy && time.Since(last) > timeout+every {
+			stalled = append(stalled, component)
+		}
+	}
+	check("ServicePoller", true, time.Duration(modules.Config.GetUint64("raydash.interval"))*time.Second)
+	check("StatsHandler", true, time.Duration(modules.Config.GetUint64("agent.statsinterval"))*time.Second)
+	check("ServiceHandler", len(r.schan) != 0 || len(r.nchan) != 0, 0)
+	check("StatsSender", len(r.statsChannel) != 0, 0)
+	return stalled
+}
+
+// Watchdog tell systemd agent is ready once first sync is applied,
+// then ping systemd watchdog only while workers make progress
+// a hung agent stops pinging and is restarted by systemd
+type Watchdog struct {
+	WaitGroup *sync.WaitGroup
+	agent     *RayAgent
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewWatchdog returns a ptr of Watchdog instance
+func NewWatchdog(r *RayAgent) *Watchdog {
+	return &Watchdog{
+		agent: r,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start start the instance
+func (d *Watchdog) Start() {
+	d.WaitGroup.Add(1)
+	go d.run()
+	utils.Log.Info("Watchdog Started")
+	return
+}
+
+// Stop stop the instance and tell systemd agent is shutting down
+func (d *Watchdog) Stop() {
+	close(d.stop)
+	<-d.done
+	d.notify("STOPPING=1")
+	d.WaitGroup.Done()
+	return
+}
+
+func (d *Watchdog) run() {
+	defer close(d.done)
+
+	// Readiness is checked every second until first sync is applied
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	checkC := check.C
+
+	// Ping twice per watchdog timeout, as systemd suggests
+	var pingC <-chan time.Time
+	if interval := systemd.WatchdogInterval(); interval != 0 {
+		ping := time.NewTicker(interval / 2)
+		defer ping.Stop()
+		pingC = ping.C
+	}
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-checkC:
+			if _, ready := d.agent.readiness(); !ready {
+				continue
+			}
+			checkC = nil
+			d.notify("READY=1")
+			utils.Log.Info("RayAgent Ready")
+		case <-pingC:
+			if stalled := d.agent.stalled(); len(stalled) != 0 {
+				utils.Log.WithField("stalled", stalled).Error("Workers Stalled, Withholding Watchdog Ping")
+				continue
+			}
+			d.notify("WATCHDOG=1")
+		}
+	}
+}
+
+func (d *Watchdog) notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		utils.Log.WithError(err).Warn("Error Notifying Systemd")
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/driver"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/utils"
+)
+
+// Heartbeat report node runtime status to backend periodically
+// so the panel can tell whether the agent is alive
+type Heartbeat struct {
+	Interval  uint64 // interval in second
+	WaitGroup *sync.WaitGroup
+	driver    driver.Driver
+	reporter  backend.StatusReporter
+	stop      chan struct{}
+	reset     chan uint64 // new Interval for running ticker
+}
+
+// NewHeartbeat returns a ptr of Heartbeat instance
+func NewHeartbeat(reporter backend.StatusReporter, d driver.Driver) *Heartbeat {
+	return &Heartbeat{
+		driver:   d,
+		reporter: reporter,
+		stop:     make(chan struct{}),
+		reset:    make(chan uint64, 1),
+	}
+}
+
+// Start start the instance
+func (h *Heartbeat) Start() {
+	h.WaitGroup.Add(1)
+	h.startTicker(h.beat)
+	utils.Log.Info("Heartbeat Started")
+	return
+}
+
+// Stop stop the instance
+func (h *Heartbeat) Stop() {
+	close(h.stop)
+	h.WaitGroup.Done()
+	return
+}
+
+// SetInterval restart running ticker with new interval in second
+func (h *Heartbeat) SetInterval(interval uint64) {
+	if interval == h.Interval {
+		return
+	}
+	h.Interval = interval
+	h.reset <- interval
+	return
+}
+
+func (h *Heartbeat) beat() {
+	status := h.collect()
+	if err := h.reporter.ReportNodeStatus(context.Background(), status); err != nil {
+		utils.Log.WithError(err).Warn("Error Sending Heartbeat")
+		return
+	}
+	utils.Log.Debug("Heartbeat Sent")
+	return
+}
+
+// collect gather node status from v2ray and other workers
+func (h *Heartbeat) collect() *models.NodeStatus {
+	status := agentStatus.nodeStatus()
+
+	sysStats, err := h.driver.GetSysStats()
+	if err != nil {
+		utils.Log.WithError(err).Warn("V2Ray Unreachable")
+		return status
+	}
+	status.V2RayReachable = true
+	status.V2RayStats = sysStats
+	return status
+}
+
+func (h *Heartbeat) startTicker(worker func()) {
+	ticker := time.NewTicker(time.Second * time.Duration(h.Interval))
+	go func() {
+		defer func() { ticker.Stop() }()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case interval := <-h.reset:
+				ticker.Stop()
+				ticker = time.NewTicker(time.Second * time.Duration(interval))
+			case <-ticker.C:
+				worker()
+			}
+		}
+	}()
+	return
+}
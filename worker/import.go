@@ -0,0 +1,295 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/raydash"
+	"github.com/coolray-dev/rayagent/utils"
+)
+
+// Migration is users and services pulled out of a hand-managed v2ray config
+type Migration struct {
+	NodeID   uint64           `json:"node_id"`
+	Users    []models.User    `json:"users"`
+	Services []models.Service `json:"services"`
+	Report   ImportReport     `json:"report"`
+}
+
+// ImportReport list what could not be imported as is
+type ImportReport struct {
+	Skipped   []string         `json:"skipped"`   // inbounds or clients not imported at all
+	Conflicts []ImportConflict `json:"conflicts"` // clients clashing with each other or with backend
+}
+
+// ImportConflict is a client that cannot be created without a human decision
+type ImportConflict struct {
+	Email  string `json:"email"`
+	Port   uint   `json:"port"`
+	Reason string `json:"reason"`
+}
+
+// v2ray json config, only what import needs
+type v2rayConfig struct {
+	Inbounds []v2rayInbound `json:"inbounds"`
+}
+
+type v2rayInbound struct {
+	Tag            string          `json:"tag"`
+	Port           json.RawMessage `json:"port"`
+	Protocol       string          `json:"protocol"`
+	Settings       json.RawMessage `json:"settings"`
+	StreamSettings struct {
+		Network string `json:"network"`
+	} `json:"streamSettings"`
+}
+
+type v2rayClient struct {
+	ID       string `json:"id"`
+	AlterID  uint   `json:"alterId"`
+	Email    string `json:"email"`
+	Method   string `json:"method"`
+	Password string `json:"password"`
+}
+
+// ParseV2RayConfig pull vmess and shadowsocks clients out of a v2ray config
+// every user gets maxTraffic, since v2ray has no quota of its own
+func ParseV2RayConfig(r io.Reader, nodeID uint64, maxTraffic uint64) (*Migration, error) {
+	var config v2rayConfig
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return nil, fmt.Errorf("Error Parsing V2Ray Config: %w", err)
+	}
+
+	m := &Migration{
+		NodeID:   nodeID,
+		Users:    make([]models.User, 0),
+		Services: make([]models.Service, 0),
+	}
+	seen := make(map[string]bool)
+	seenUsernames := make(map[string]bool)
+	for _, inbound := range config.Inbounds {
+		name := inbound.Tag
+		if name == "" {
+			name = inbound.Protocol
+		}
+		protocol := strings.ToLower(inbound.Protocol)
+		if protocol != "vmess" && protocol != "shadowsocks" {
+			m.Report.Skipped = append(m.Report.Skipped, fmt.Sprintf("inbound %s: protocol %s not supported", name, inbound.Protocol))
+			continue
+		}
+		port, err := parsePort(inbound.Port)
+		if err != nil {
+			m.Report.Skipped = append(m.Report.Skipped, fmt.Sprintf("inbound %s: %s", name, err))
+			continue
+		}
+		clients, err := parseClients(protocol, inbound.Settings)
+		if err != nil {
+			m.Report.Skipped = append(m.Report.Skipped, fmt.Sprintf("inbound %s: %s", name, err))
+			continue
+		}
+
+		for i, c := range clients {
+			if c.Email == "" {
+				c.Email = fmt.Sprintf("%s-%d-%d@import.local", protocol, port, i)
+			}
+			if seen[c.Email] {
+				m.Report.Conflicts = append(m.Report.Conflicts, ImportConflict{
+					Email:  c.Email,
+					Port:   port,
+					Reason: "email used by another client in config",
+				})
+				continue
+			}
+			seen[c.Email] = true
+
+			u := models.User{
+				Email:      c.Email,
+				Username:   usernameOf(c.Email),
+				MaxTraffic: maxTraffic,
+			}
+			if seenUsernames[u.Username] {
+				m.Report.Conflicts = append(m.Report.Conflicts, ImportConflict{
+					Email:  c.Email,
+					Port:   port,
+					Reason: "username " + u.Username + " used by another client in config",
+				})
+				continue
+			}
+			seenUsernames[u.Username] = true
+			if err := modules.Validator.Struct(&u); err != nil {
+				m.Report.Skipped = append(m.Report.Skipped, fmt.Sprintf("client %s: %s", c.Email, err))
+				continue
+			}
+			s := models.Service{
+				Name:     "imported-" + name,
+				NodeID:   nodeID,
+				Port:     port,
+				Protocol: protocol,
+			}
+			s.VmessSetting.StreamSettings.TransportProtocol = transportOf(inbound.StreamSettings.Network)
+			s.VmessUser.Email = c.Email
+			switch protocol {
+			case "vmess":
+				s.VmessUser.UUID = c.ID
+				s.VmessUser.AlterID = c.AlterID
+			case "shadowsocks":
+				s.ShadowsocksUser.Method = c.Method
+				s.ShadowsocksUser.Password = c.Password
+			}
+			m.Users = append(m.Users, u)
+			m.Services = append(m.Services, s)
+		}
+	}
+	return m, nil
+}
+
+// CheckConflicts compare migration with users and services already in backend
+// clashing clients are moved from migration into report
+func (m *Migration) CheckConflicts(ctx context.Context, b backend.Backend) error {
+	node, err := b.GetNode(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting NodeInfo: %w", err)
+	}
+	users, err := b.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting Users: %w", err)
+	}
+	services, err := b.ListServices(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting Services: %w", err)
+	}
+
+	existingEmails := make(map[string]bool)
+	existingUsernames := make(map[string]bool)
+	for i := range users {
+		existingEmails[users[i].Email] = true
+		existingUsernames[users[i].Username] = true
+	}
+	usedPorts := make(map[uint]string)
+	for i := range services {
+		existingEmails[services[i].Email] = true
+		usedPorts[services[i].Port] = services[i].Email
+	}
+
+	keptUsers := make([]models.User, 0, len(m.Users))
+	keptServices := make([]models.Service, 0, len(m.Services))
+	for i := range m.Services {
+		s, u := m.Services[i], m.Users[i]
+		reason := ""
+		switch {
+		case existingEmails[s.Email]:
+			reason = "email exists in backend"
+		case existingUsernames[u.Username]:
+			reason = "username " + u.Username + " exists in backend"
+		case node.HasMultiPort && usedPorts[s.Port] != "":
+			reason = "port used by " + usedPorts[s.Port]
+		}
+		if reason != "" {
+			m.Report.Conflicts = append(m.Report.Conflicts, ImportConflict{Email: s.Email, Port: s.Port, Reason: reason})
+			continue
+		}
+		if node.HasMultiPort {
+			usedPorts[s.Port] = s.Email
+		}
+		keptUsers = append(keptUsers, u)
+		keptServices = append(keptServices, s)
+	}
+	m.Users, m.Services = keptUsers, keptServices
+	return nil
+}
+
+// Post create users and services of migration in RayDash
+// objects RayDash already has are reported as conflicts, others are created anyway
+func (m *Migration) Post(ctx context.Context, client *raydash.Client) error {
+	failed := 0
+	for i := range m.Users {
+		if err := client.CreateUser(ctx, &m.Users[i]); err != nil {
+			if raydash.IsConflict(err) {
+				m.Report.Conflicts = append(m.Report.Conflicts, ImportConflict{Email: m.Users[i].Email, Port: m.Services[i].Port, Reason: "user exists in RayDash"})
+				continue
+			}
+			utils.Log.WithError(err).Errorf("Error Creating User %s", m.Users[i].Email)
+			failed++
+			continue
+		}
+		if err := client.CreateService(ctx, m.NodeID, &m.Services[i]); err != nil {
+			if raydash.IsConflict(err) {
+				m.Report.Conflicts = append(m.Report.Conflicts, ImportConflict{Email: m.Services[i].Email, Port: m.Services[i].Port, Reason: "service exists in RayDash"})
+				continue
+			}
+			utils.Log.WithError(err).Errorf("Error Creating Service Of %s", m.Services[i].Email)
+			failed++
+			continue
+		}
+		utils.Log.Infof("Successfully Imported User %s", m.Users[i].Email)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d users failed to import", failed, len(m.Users))
+	}
+	return nil
+}
+
+// parsePort accept port as number or numeric string, ranges cannot be mapped to a service
+func parsePort(raw json.RawMessage) (uint, error) {
+	var port uint
+	if err := json.Unmarshal(raw, &port); err == nil && port != 0 {
+		return port, nil
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		if p, err := strconv.ParseUint(str, 10, 16); err == nil && p != 0 {
+			return uint(p), nil
+		}
+	}
+	return 0, fmt.Errorf("port %s is not a single port", string(raw))
+}
+
+// parseClients return clients of an inbound
+// a v2ray shadowsocks inbound has one user in settings itself
+func parseClients(protocol string, raw json.RawMessage) ([]v2rayClient, error) {
+	var settings struct {
+		Clients []v2rayClient `json:"clients"`
+		v2rayClient
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	if protocol == "shadowsocks" && len(settings.Clients) == 0 {
+		if settings.Password == "" {
+			return nil, fmt.Errorf("shadowsocks inbound has no password")
+		}
+		return []v2rayClient{settings.v2rayClient}, nil
+	}
+	return settings.Clients, nil
+}
+
+// usernameOf derive a username from local part of email
+func usernameOf(email string) string {
+	if i := strings.Index(email, "@"); i > 0 {
+		return email[:i]
+	}
+	return email
+}
+
+// transportOf map v2ray json network to transport protocol name used by models
+func transportOf(network string) string {
+	switch strings.ToLower(network) {
+	case "", "tcp":
+		return "tcp"
+	case "ws":
+		return "websocket"
+	case "kcp":
+		return "mkcp"
+	case "h2":
+		return "http"
+	default:
+		return strings.ToLower(network)
+	}
+}
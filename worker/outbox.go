@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+)
+
+// outboxFile is where traffic backend did not take is kept across restarts
+const outboxFile = "outbox.json"
+
+// outbox keeps traffic reports backend did not take, one merged report per user
+// core counters are reset once read, so outbox holds the only copy of that traffic
+// it is written to state directory on every change, if it has a name
+type outbox struct {
+	name    string
+	lock    sync.Mutex
+	pending map[string]*models.Traffic // by email
+}
+
+// newOutbox return outbox kept in file name of state directory, with what it held last run
+// empty name keeps outbox in memory only
+func newOutbox(name string) *outbox {
+	o := &outbox{
+		name:    name,
+		pending: make(map[string]*models.Traffic),
+	}
+	if name == "" {
+		return o
+	}
+	var saved []models.Traffic
+	if err := modules.ReadState(name, &saved); err != nil {
+		if !os.IsNotExist(err) {
+			statsLog.WithError(err).Error("Error Reading Traffic Outbox")
+		}
+		return o
+	}
+	for i := range saved {
+		o.pending[saved[i].User.Email] = &saved[i]
+	}
+	if len(saved) != 0 {
+		statsLog.WithField("pending", len(saved)).Warn("Traffic Outbox Left By Last Run, Reporting It Again")
+	}
+	return o
+}
+
+// mergeTraffic add traffic of b to a, user of the newer one is kept
+// RayDash takes accumulated traffic of user, so an older user must never win
+func mergeTraffic(a models.Traffic, b models.Traffic) models.Traffic {
+	if b.Time.After(a.Time) {
+		a.User = b.User
+		a.Time = b.Time
+	}
+	a.Uplink += b.Uplink
+	a.Downlink += b.Downlink
+	return a
+}
+
+// put keep traffic until it is reported, merged with what is kept for its user
+func (o *outbox) put(traffic []models.Traffic) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for i := range traffic {
+		t := traffic[i] // each entry needs a variable of its own
+		if pending, found := o.pending[t.User.Email]; found {
+			t = mergeTraffic(*pending, t)
+		}
+		o.pending[t.User.Email] = &t
+	}
+	o.save()
+	return
+}
+
+// replace keep traffic as the only report of its user, it already holds what was kept
+func (o *outbox) replace(traffic models.Traffic) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.pending[traffic.User.Email] = &traffic
+	o.save()
+	return
+}
+
+// get return traffic kept for email
+func (o *outbox) get(email string) (models.Traffic, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	t, found := o.pending[email]
+	if !found {
+		return models.Traffic{}, false
+	}
+	return *t, true
+}
+
+// remove drop traffic of emails once backend took it
+func (o *outbox) remove(emails ...string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, email := range emails {
+		delete(o.pending, email)
+	}
+	o.save()
+	return
+}
+
+// all return every traffic kept, ordered by email
+func (o *outbox) all() []models.Traffic {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	traffic := make([]models.Traffic, 0, len(o.pending))
+	for _, t := range o.pending {
+		traffic = append(traffic, *t)
+	}
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].User.Email < traffic[j].User.Email })
+	return traffic
+}
+
+// len return number of users with traffic waiting to be reported
+func (o *outbox) len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.pending)
+}
+
+// save write outbox to state directory, caller holds lock
+// a failed write is only logged, traffic is still kept in memory
+func (o *outbox) save() {
+	if o.name == "" {
+		return
+	}
+	traffic := make([]models.Traffic, 0, len(o.pending))
+	for _, t := range o.pending {
+		traffic = append(traffic, *t)
+	}
+	if err := modules.WriteState(o.name, traffic); err != nil {
+		statsLog.WithError(err).Error("Error Saving Traffic Outbox")
+	}
+	return
+}
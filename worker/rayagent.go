@@ -1,13 +1,22 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/coolray-dev/rayagent/audit"
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/driver"
+	"github.com/coolray-dev/rayagent/metrics"
 	"github.com/coolray-dev/rayagent/models"
 	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/raydash"
+	"github.com/coolray-dev/rayagent/supervisor"
 	"github.com/coolray-dev/rayagent/utils"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -22,17 +31,28 @@ type RayAgent struct {
 	serviceHandler *ServiceHandler
 	statsHandler   *StatsHandler
 	statsSender    *StatsSender
+	heartbeat      *Heartbeat
+	backend        backend.Backend
 	waitGroup      *sync.WaitGroup
-	schan          chan []models.Service
+	schan          chan ServiceBatch
+	nchan          chan *models.Node
 	statsChannel   chan *models.Stats
 	gRPCConn       *grpc.ClientConn
+	driver         driver.Driver
+	supervisor     *supervisor.Supervisor
+	admin          *AdminServer
+	metricsServer  *http.Server
+	health         *HealthServer
+	watchdog       *Watchdog
+	audit          *audit.Logger
 }
 
 // NewRayAgent return a rayagent
 func NewRayAgent(wg *sync.WaitGroup) *RayAgent {
 	return &RayAgent{
 		waitGroup:    wg,
-		schan:        make(chan []models.Service, 10),
+		schan:        make(chan ServiceBatch, 10),
+		nchan:        make(chan *models.Node, 1),
 		statsChannel: make(chan *models.Stats, 10),
 	}
 }
@@ -41,78 +61,307 @@ func NewRayAgent(wg *sync.WaitGroup) *RayAgent {
 func (r *RayAgent) Start() {
 
 	// Set worker nodeInfo
-	nodeInfo.Token = modules.Config.GetString("raydash.token")
-	nodeInfo.ID = modules.Config.GetUint64("raydash.nodeID")
-	initUserPool()
-	r.startServicePoller()
+	nodeInfo.ID = modules.NodeID()
+	r.startBackend()
+	snap := initUserPool(r.backend)
+	r.startServicePoller(snap)
 
-	r.startV2RayConnection()
-	// Create ServiceClients
-	handlerServiceClient := modules.NewHandlerServiceClient(r.gRPCConn, modules.Config.GetString("v2ray.inbound"))
-	statsServiceClient := modules.NewStatsServiceClient(r.gRPCConn)
-	r.getNodeInfo()
-	r.startServiceHandler(handlerServiceClient)
+	// Create core driver
+	r.startSupervisor()
+	r.startDriver()
+	r.getNodeInfo(snap)
+	r.startServiceHandler()
 
-	r.startStatsHandler(statsServiceClient)
+	r.startStatsHandler()
 	r.startStatsSender()
+	r.startHeartbeat()
+	r.startAdmin()
+	r.startMetrics()
+	r.startHealth()
+	r.startWatchdog()
 
 	utils.Log.Info("RayAgent Started Successfully")
 	return
 }
 
 // Stop stop a rayagent
-func (r *RayAgent) Stop() {
+// workers are stopped in order, traffic not reported yet is flushed until ctx is done
+// an error is returned if some traffic could not be reported
+func (r *RayAgent) Stop(ctx context.Context) error {
+	r.watchdog.Stop()
+	if r.health != nil {
+		r.health.Stop()
+	}
+	if r.admin != nil {
+		r.admin.Stop()
+	}
+	if r.metricsServer != nil {
+		r.metricsServer.Close()
+	}
+	if r.heartbeat != nil {
+		r.heartbeat.Stop()
+	}
 	fmt.Print("Stopping ServicePoller...")
 	r.servicePoller.Stop()
-	fmt.Println("Done")
 	r.serviceHandler.Stop()
-	fmt.Print("Stopping Stats Workers...")
-	r.statsSender.Stop()
-	r.statsHandler.Stop()
 	fmt.Println("Done")
+
+	// Final sample goes into channel before sender drains it
+	fmt.Print("Flushing Traffic...")
+	r.statsHandler.Stop()
+	err := r.statsSender.Stop(ctx)
+	if err != nil {
+		fmt.Println("Failed")
+	} else {
+		fmt.Println("Done")
+	}
+
+	if closer, ok := r.backend.(io.Closer); ok {
+		closer.Close()
+	}
+	r.audit.Close()
+	if closer, ok := r.driver.(io.Closer); ok {
+		closer.Close()
+	}
+	if r.supervisor != nil {
+		fmt.Print("Stopping V2Ray...")
+		r.supervisor.Stop()
+		fmt.Println("Done")
+	}
+	return err
 }
 
-func (r *RayAgent) startServicePoller() {
+// Reload read config file again and apply changed settings to running workers
+// config is left untouched if the new one is invalid or changes settings only a restart can apply
+func (r *RayAgent) Reload() error {
+	changed, err := modules.ReloadConfig()
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		utils.Log.Info("Config Unchanged")
+		return nil
+	}
 
-	r.servicePoller = NewServicePoller(modules.Config.GetString("raydash.url"),
+	utils.SetLevels(modules.Config.GetString("log.level"), modules.Config.GetStringMapString("log.levels"))
+	r.servicePoller.SetInterval(modules.Config.GetUint64("raydash.interval"),
+		modules.Config.GetUint64("raydash.nodeinterval"))
+	r.statsHandler.SetInterval(modules.Config.GetUint64("agent.statsinterval"))
+	if r.heartbeat != nil {
+		r.heartbeat.SetInterval(modules.Config.GetUint64("raydash.heartbeat"))
+	}
+	if b, ok := r.backend.(*backend.RayDashBackend); ok {
+		b.Client().SetCredentials(modules.Config.GetString("raydash.url"),
+			modules.Config.GetString("raydash.token"))
+	}
+	utils.Log.WithField("changed", changed).Info("Config Reloaded")
+	return nil
+}
+
+func (r *RayAgent) startBackend() {
+	b, err := NewBackend()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Error Creating Backend")
+	}
+	r.backend = b
+}
+
+// NewBackend create backend chosen in config
+func NewBackend() (backend.Backend, error) {
+	switch modules.Config.GetString("backend.type") {
+	case "file":
+		b, err := backend.NewFileBackend(modules.Config.GetString("backend.path"),
+			modules.Config.GetString("backend.ledger"))
+		if err != nil {
+			return nil, fmt.Errorf("Error Loading Backend File: %w", err)
+		}
+		return b, nil
+	case "sspanel":
+		return backend.NewSSPanelBackend(modules.Config.GetString("backend.url"),
+			modules.Config.GetString("backend.token"),
+			modules.Config.GetUint64("backend.nodeID")), nil
+	case "v2board":
+		return backend.NewV2BoardBackend(modules.Config.GetString("backend.url"),
+			modules.Config.GetString("backend.token"),
+			modules.Config.GetUint64("backend.nodeID"),
+			modules.Config.GetUint("backend.localport")), nil
+	default:
+		client := raydash.NewClient(modules.Config.GetString("raydash.url"),
+			modules.Config.GetString("raydash.token"))
+		client.PageSize = modules.Config.GetUint64("raydash.pagesize")
+		client.Retries = modules.Config.GetInt("raydash.retries")
+		client.RetryInterval = time.Duration(modules.Config.GetUint64("raydash.retryinterval")) * time.Second
+		client.Observer = metrics.ObserveRayDash
+		return backend.NewRayDashBackend(client, modules.Config.GetUint64("raydash.nodeID")), nil
+	}
+}
+
+func (r *RayAgent) startServicePoller(snap *snapshot) {
+
+	r.servicePoller = NewServicePoller(r.backend,
 		modules.Config.GetUint64("raydash.interval"),
 		r.schan)
+	r.servicePoller.NodeInterval = modules.Config.GetUint64("raydash.nodeinterval")
+	r.servicePoller.NodeChannel = r.nchan
 	r.servicePoller.WaitGroup = r.waitGroup
+
+	// Serve users in snapshot until backend is back
+	if snap != nil {
+		r.servicePoller.Offline = true
+		r.schan <- ServiceBatch{Services: snap.Services}
+	}
 	r.servicePoller.Start()
 }
 
-func (r *RayAgent) startServiceHandler(hc *modules.HandlerServiceClient) {
+func (r *RayAgent) startSupervisor() {
+	if !modules.Config.GetBool("v2ray.supervise") {
+		return
+	}
+	r.supervisor = supervisor.NewSupervisor(modules.Config.GetString("v2ray.binary"),
+		modules.StatePath("v2ray.json"),
+		modules.Config.GetString("v2ray.grpcaddr"))
+	// A restarted v2ray knows nothing about inbounds and users
+	r.supervisor.OnRestart = func() {
+		if r.serviceHandler != nil {
+			r.serviceHandler.Reapply()
+		}
+	}
+	if err := r.supervisor.Start(30 * time.Second); err != nil {
+		utils.Log.WithError(err).Fatal("Error Starting V2Ray")
+	}
+}
+
+func (r *RayAgent) startDriver() {
+	switch modules.Config.GetString("v2ray.driver") {
+	case "embedded":
+		// v2ray runs in-process, no gRPC connection needed
+		e, err := driver.NewEmbedded()
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Error Starting Embedded V2Ray")
+		}
+		r.driver = driver.NewInstrumented(e)
+		utils.Log.Info("Embedded V2Ray Started")
+		return
+	}
+
+	r.startV2RayConnection()
+	r.driver = driver.NewInstrumented(newDriver(r.gRPCConn))
+}
+
+// newDriver create driver chosen in config talking to core over conn
+func newDriver(conn *grpc.ClientConn) driver.Driver {
+	switch modules.Config.GetString("v2ray.driver") {
+	case "xray":
+		x := driver.NewXray(conn)
+		x.CertFile = modules.Config.GetString("v2ray.certfile")
+		x.KeyFile = modules.Config.GetString("v2ray.keyfile")
+		return x
+	default:
+		return driver.NewV2Ray(conn)
+	}
+}
+
+func (r *RayAgent) startServiceHandler() {
 	// Create Services Handler to handler Service slice passed from channel
-	r.serviceHandler = NewServiceHandler(r.nodeID, r.nodeInfo, *hc, r.schan)
+	r.serviceHandler = NewServiceHandler(r.nodeID, r.nodeInfo, r.driver, r.schan)
 	r.serviceHandler.Tag = modules.Config.GetString("v2ray.inbound")
+	r.serviceHandler.NodeChannel = r.nchan
 	r.serviceHandler.WaitGroup = r.waitGroup
+
+	// Changes to core are audited, there is no point running without it
+	var err error
+	if r.audit, err = newAuditLogger(); err != nil {
+		utils.Log.WithError(err).Fatal("Error Opening Audit Log")
+	}
+	r.serviceHandler.Audit = r.audit
 	r.serviceHandler.Start()
 }
 
-func (r *RayAgent) startStatsHandler(sc *modules.StatsServiceClient) {
+func (r *RayAgent) startStatsHandler() {
 	// Create Stats Workers
-	r.statsHandler = NewStatsHandler(sc)
+	r.statsHandler = NewStatsHandler(r.driver)
 	r.statsHandler.NodeID = r.nodeID
 	r.statsHandler.NodeInfo = r.nodeInfo
-	r.statsHandler.Interval = 10
+	r.statsHandler.Interval = modules.Config.GetUint64("agent.statsinterval")
 	r.statsHandler.StatsChannel = r.statsChannel
 	r.statsHandler.WaitGroup = r.waitGroup
+	r.statsHandler.Inbounds = r.serviceHandler.InboundTags
 	r.statsHandler.Start() // statsHandler.Start not blocking, no need to use goroutine
 }
 
 func (r *RayAgent) startStatsSender() {
-	r.statsSender = NewStatsSender()
-	r.statsSender.RayDashURL = modules.Config.GetString("raydash.url")
+	r.statsSender = NewStatsSender(r.backend)
 	r.statsSender.Interval = 10
+	r.statsSender.OutboxFile = outboxFile
 	r.statsSender.StatsChannel = r.statsChannel
 	r.statsSender.WaitGroup = r.waitGroup
 	r.statsSender.Start()
 }
 
+func (r *RayAgent) startHeartbeat() {
+	// Not every backend accepts heartbeats
+	reporter, ok := r.backend.(backend.StatusReporter)
+	if !ok {
+		return
+	}
+	r.heartbeat = NewHeartbeat(reporter, r.driver)
+	r.heartbeat.Interval = modules.Config.GetUint64("raydash.heartbeat")
+	r.heartbeat.WaitGroup = r.waitGroup
+	r.heartbeat.Start()
+}
+
+func (r *RayAgent) startAdmin() {
+	listen := modules.Config.GetString("admin.listen")
+	if listen == "" {
+		return
+	}
+	r.admin = NewAdminServer(r, listen, modules.Config.GetString("admin.token"))
+	if err := r.admin.Start(); err != nil {
+		utils.Log.WithError(err).Error("Error Starting Admin API")
+		r.admin = nil
+	}
+}
+
+func (r *RayAgent) startMetrics() {
+	listen := modules.Config.GetString("metrics.listen")
+	if listen == "" {
+		return
+	}
+	metrics.PerUser = modules.Config.GetBool("metrics.peruser")
+	metrics.ChannelDepth("schan", func() int { return len(r.schan) })
+	metrics.ChannelDepth("nchan", func() int { return len(r.nchan) })
+	metrics.ChannelDepth("statsChannel", func() int { return len(r.statsChannel) })
+	metrics.OutboxBacklog(r.statsSender.Pending)
+	var err error
+	if r.metricsServer, err = metrics.Serve(listen); err != nil {
+		utils.Log.WithError(err).Error("Error Starting Metrics Exporter")
+		return
+	}
+	utils.Log.WithField("listen", listen).Info("Metrics Exporter Started")
+}
+
+func (r *RayAgent) startHealth() {
+	listen := modules.Config.GetString("health.listen")
+	if listen == "" {
+		return
+	}
+	r.health = NewHealthServer(r, listen)
+	if err := r.health.Start(); err != nil {
+		utils.Log.WithError(err).Error("Error Starting Health Endpoints")
+		r.health = nil
+	}
+}
+
+func (r *RayAgent) startWatchdog() {
+	r.watchdog = NewWatchdog(r)
+	r.watchdog.WaitGroup = r.waitGroup
+	r.watchdog.Start()
+}
+
 func (r *RayAgent) startV2RayConnection() {
 	gRPCAddr := modules.Config.GetString("v2ray.grpcaddr")
 	var err error
-	r.gRPCConn, err = modules.ConnectGRPC(gRPCAddr, 10*time.Second)
+	r.gRPCConn, err = modules.ConnectGRPC(gRPCAddr, 10*time.Second, grpc.WithUnaryInterceptor(metrics.UnaryClientInterceptor))
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			err = errors.New(s.Message())
@@ -122,14 +371,25 @@ func (r *RayAgent) startV2RayConnection() {
 	utils.Log.Info("gRPC Connected")
 }
 
-func (r *RayAgent) getNodeInfo() {
-	r.nodeID = modules.Config.GetUint64("raydash.nodeID")
+func (r *RayAgent) getNodeInfo(snap *snapshot) {
+	r.nodeID = modules.NodeID()
 	var err error
-	r.nodeInfo, err = r.servicePoller.GetNodeInfo(r.nodeID)
-	if err != nil {
+	r.nodeInfo, err = r.servicePoller.GetNodeInfo()
+	if err == nil {
+		return
+	}
+
+	// Fall back to node info in snapshot
+	if snap == nil {
+		snap, _ = loadSnapshot()
+	}
+	if snap == nil || snap.Node == nil {
 		utils.Log.WithFields(logrus.Fields{
 			"error":  err,
 			"nodeID": r.nodeID,
 		}).Fatal("Error Getting NodeInfo")
 	}
+	utils.Log.WithError(err).Warn("Error Getting NodeInfo, Using Snapshot")
+	r.nodeInfo = snap.Node
+	r.servicePoller.setNode(snap.Node)
 }
@@ -0,0 +1,85 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/raydash"
+	"github.com/coolray-dev/rayagent/utils"
+)
+
+// Register trade a one-time bootstrap token for node credentials
+// and save them to local state directory, so no config editing is needed
+func Register(bootstrapToken string, ports []uint, force bool) (*models.Credentials, error) {
+	if bootstrapToken == "" {
+		return nil, errors.New("bootstrap token not set")
+	}
+	if _, err := modules.LoadCredentials(); err == nil && !force {
+		return nil, fmt.Errorf("node already registered, credentials found in %s", modules.StatePath(modules.CredentialsFile))
+	}
+
+	facts, err := collectHostFacts(ports)
+	if err != nil {
+		return nil, fmt.Errorf("Error Collecting Host Facts: %w", err)
+	}
+
+	client := raydash.NewBootstrapClient(modules.Config.GetString("raydash.url"), bootstrapToken)
+	creds, err := client.RegisterNode(context.Background(), facts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := modules.SaveCredentials(creds); err != nil {
+		return nil, fmt.Errorf("Error Saving Credentials: %w", err)
+	}
+	return creds, nil
+}
+
+func collectHostFacts(ports []uint) (*models.HostFacts, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	ips, err := publicIPs()
+	if err != nil {
+		return nil, err
+	}
+	return &models.HostFacts{
+		Hostname:  hostname,
+		PublicIPs: ips,
+		Ports:     ports,
+		Version:   utils.Version,
+	}, nil
+}
+
+// publicIPs list global unicast addresses of all interfaces, private ranges excluded
+func publicIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0)
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || isPrivateIP(ipNet.IP) {
+			continue
+		}
+		ips = append(ips, ipNet.IP.String())
+	}
+	return ips, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, block, _ := net.ParseCIDR(cidr)
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,304 +1,778 @@
 package worker
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"reflect"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/coolray-dev/rayagent/audit"
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/driver"
 	"github.com/coolray-dev/rayagent/models"
-	"github.com/coolray-dev/rayagent/modules"
 	"github.com/coolray-dev/rayagent/utils"
 	"github.com/sirupsen/logrus"
-	"v2ray.com/core"
-	"v2ray.com/core/app/proxyman"
-	"v2ray.com/core/common/net"
-	"v2ray.com/core/common/protocol"
-	"v2ray.com/core/common/serial"
-	vmessInbound "v2ray.com/core/proxy/vmess/inbound"
-	"v2ray.com/core/transport/internet"
-	"v2ray.com/core/transport/internet/websocket"
 )
 
-// ServicePoller get services from raydash
+// ServiceBatch is services fetched in one poll, with ID of the poll for logs and audit
+type ServiceBatch struct {
+	Services []models.Service
+	Cycle    string // empty for services not from backend, e.g. snapshot
+	Revision string // backend revision of services, empty if backend has none
+}
+
+// ServicePoller get services from backend
+// node settings are polled as well, so changes in backend take effect without restart
 type ServicePoller struct {
-	RayDashURL     string // e.g. https://raydash.example.com
 	Interval       uint64 // interval in second
-	Ticker         *time.Ticker
-	ServiceChannel chan<- []models.Service
+	NodeInterval   uint64 // node settings polling interval in second
+	ServiceChannel chan<- ServiceBatch
+	NodeChannel    chan<- *models.Node
 	WaitGroup      *sync.WaitGroup
-	httpClient     *http.Client
+	Offline        bool // started from snapshot, until backend is reachable again
+	backend        backend.Backend
+	node           *models.Node // last good node info, saved in snapshot
+	force          chan struct{}
+	stop           chan struct{}
+	reset          chan uint64    // new Interval for running ticker
+	nodeReset      chan uint64    // new NodeInterval for running ticker
+	loops          sync.WaitGroup // ticker goroutines, channels are closed only after they return
+	lock           sync.Mutex
 }
 
 // NewServicePoller return a new ServicePoller with private sub set
-func NewServicePoller(url string, interval uint64, schan chan<- []models.Service) *ServicePoller {
+func NewServicePoller(b backend.Backend, interval uint64, schan chan<- ServiceBatch) *ServicePoller {
 	return &ServicePoller{
-		RayDashURL:     url,
 		Interval:       interval,
 		ServiceChannel: schan,
-		httpClient:     createHTTPClient(),
+		backend:        b,
+		force:          make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		reset:          make(chan uint64, 1),
+		nodeReset:      make(chan uint64, 1),
+	}
+}
+
+// SetInterval restart running tickers with new polling intervals in second
+func (c *ServicePoller) SetInterval(interval uint64, nodeInterval uint64) {
+	if interval != c.Interval {
+		c.Interval = interval
+		c.reset <- interval
+	}
+	if nodeInterval != c.NodeInterval && c.NodeChannel != nil {
+		c.NodeInterval = nodeInterval
+		c.nodeReset <- nodeInterval
 	}
+	return
+}
+
+// Sync ask poller to poll backend now instead of waiting for ticker
+func (c *ServicePoller) Sync() {
+	select {
+	case c.force <- struct{}{}:
+	default: // one pending request is enough
+	}
+	return
 }
 
 // Start start a instance
 func (c *ServicePoller) Start() {
 	c.WaitGroup.Add(1)
 	c.startTicker(c.getServices)
-	utils.Log.Info("ServicePoller Started")
+	if c.NodeChannel != nil {
+		c.startNodeTicker(c.getNode)
+	}
+	pollerLog.Info("ServicePoller Started")
 	return
 }
 
 // Stop stop a instance
+// a poll in progress is finished first, so nothing is sent on closed channels
 func (c *ServicePoller) Stop() {
-	c.stopTicker()
+	close(c.stop)
+	c.loops.Wait()
 	close(c.ServiceChannel)
+	if c.NodeChannel != nil {
+		close(c.NodeChannel)
+	}
 	c.WaitGroup.Done()
 	return
 }
 
-// GetNodeInfo is a general func retrieve node info from /nodes/:id
-func (c *ServicePoller) GetNodeInfo(nodeID uint64) (*models.Node, error) {
-
-	// Generate Request
-	endpoint := c.RayDashURL + "/nodes/" + strconv.Itoa(int(nodeID))
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+"node."+nodeInfo.Token)
-
-	// Call API
-	response, err := c.httpClient.Do(req)
+// GetNodeInfo is a general func retrieve node info from backend
+func (c *ServicePoller) GetNodeInfo() (*models.Node, error) {
+	node, err := c.backend.GetNode(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("Error Calling RayDash API: %w", err)
-	}
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Error Calling RayDash API: Code %d", response.StatusCode)
+		return nil, err
 	}
+	c.setNode(node)
+	return node, nil
+}
 
-	// Read Response
-	body, _ := ioutil.ReadAll(response.Body)
+// Node return last good node info
+func (c *ServicePoller) Node() *models.Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.node
+}
 
-	// Bind Response
-	type Response struct {
-		Node models.Node `json:"node"`
-	}
-	var resp Response
-	err = json.Unmarshal(body, &resp)
-	if err != nil {
-		return nil, fmt.Errorf("Error Unmarshalling Response: %w", err)
-	}
-	return &resp.Node, nil
+func (c *ServicePoller) setNode(node *models.Node) {
+	c.lock.Lock()
+	c.node = node
+	c.lock.Unlock()
 }
 
-// getServices call raydash api
+// getServices call backend
+// services are only published after every page is in
 func (c *ServicePoller) getServices() {
-
-	// Generate Request
-	endpoint := c.RayDashURL + "/nodes/" + fmt.Sprint(nodeInfo.ID) + "/services"
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+"node."+nodeInfo.Token)
-
-	// Call API
-	response, err := c.httpClient.Do(req)
+	cycle := utils.NewCycle()
+	log := pollerLog.WithField("cycle_id", cycle)
+	services, err := c.backend.ListServices(context.Background())
 	if err != nil {
-		utils.Log.WithFields(logrus.Fields{
+		log.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Error Calling RayDash API")
+		}).Error("Error Getting Services")
+		agentStatus.failed(err)
 		return
 	}
-	if response.StatusCode != http.StatusOK {
-		utils.Log.WithField("StatusCode", response.StatusCode).Error("Error Calling RayDash API")
+	revision := revisionOf(c.backend)
+	log.Debug("Successfully Got Services From Backend")
+
+	// Users go first, so services of new users are applied and removed users lose theirs
+	if err := refreshUserPool(c.backend); err != nil {
+		log.WithError(err).Error("Error Refreshing Users")
+		agentStatus.failed(err)
 		return
 	}
-	utils.Log.Debug("Successfully Called RayDash API:" + endpoint)
-	body, _ := ioutil.ReadAll(response.Body)
-	type services struct {
-		Services []models.Service `json:"services"`
-		Total    uint64           `json:"total"`
+	if c.Offline {
+		c.Offline = false
+		log.Info("Backend Reachable Again, Reconciling With Snapshot")
+	}
+
+	agentStatus.synced()
+	// Handler may be waiting for core to take its inbound, stop must not wait on it
+	select {
+	case c.ServiceChannel <- ServiceBatch{Services: services, Cycle: cycle, Revision: revision}:
+	case <-c.stop:
+		return
 	}
-	var s services
-	err = json.Unmarshal(body, &s)
+
+	c.lock.Lock()
+	node := c.node
+	c.lock.Unlock()
+	if node == nil {
+		return
+	}
+	if err := saveSnapshot(node, services); err != nil {
+		log.WithError(err).Warn("Error Saving Snapshot")
+	}
+	return
+}
+
+// getNode call backend for node settings
+// ServiceHandler decides whether anything changed
+func (c *ServicePoller) getNode() {
+	node, err := c.backend.GetNode(context.Background())
 	if err != nil {
-		utils.Log.WithFields(logrus.Fields{
+		pollerLog.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Error Parsing RayDash API Response")
+		}).Error("Error Getting NodeInfo")
+		agentStatus.failed(err)
+		return
+	}
+	c.setNode(node)
+	select {
+	case c.NodeChannel <- node:
+	case <-c.stop:
 	}
-	c.ServiceChannel <- s.Services
 	return
 }
 
-func (c *ServicePoller) startTicker(worker func()) {
-	ticker := time.NewTicker(time.Second * time.Duration(c.Interval))
+func (c *ServicePoller) startNodeTicker(worker func()) {
+	interval := c.NodeInterval
+	c.loops.Add(1)
 	go func() {
-		for range ticker.C {
-			worker()
-		}
+		defer c.loops.Done()
+		supervise("NodePoller", pollerLog, c.stop, func() {
+			ticker := time.NewTicker(time.Second * time.Duration(interval))
+			defer func() { ticker.Stop() }()
+			for {
+				select {
+				case <-c.stop:
+					return
+				case interval = <-c.nodeReset:
+					ticker.Stop()
+					ticker = time.NewTicker(time.Second * time.Duration(interval))
+				case <-ticker.C:
+					worker()
+				}
+			}
+		})
 	}()
-	c.Ticker = ticker
 	return
 }
 
-func (c *ServicePoller) stopTicker() {
-	c.Ticker.Stop()
+func (c *ServicePoller) startTicker(worker func()) {
+	interval := c.Interval
+
+	// Sync immediately if backend tells us about changes
+	var changed <-chan struct{}
+	if n, ok := c.backend.(backend.Notifier); ok {
+		changed = n.Changed()
+	}
+	c.loops.Add(1)
+	go func() {
+		defer c.loops.Done()
+		supervise("ServicePoller", pollerLog, c.stop, func() {
+			ticker := time.NewTicker(time.Second * time.Duration(interval))
+			defer func() { ticker.Stop() }()
+			for {
+				select {
+				case <-c.stop:
+					return
+				case interval = <-c.reset:
+					ticker.Stop()
+					ticker = time.NewTicker(time.Second * time.Duration(interval))
+					continue
+				case <-ticker.C:
+				case <-changed:
+					if c.NodeChannel != nil {
+						c.getNode()
+					}
+				case <-c.force:
+					if c.NodeChannel != nil {
+						c.getNode()
+					}
+				}
+				worker()
+				agentStatus.beat("ServicePoller")
+			}
+		})
+	}()
 	return
 }
 
-// ServiceHandler is a handler controls incoming services info and talk to v2ray through handlerServiceClient
+// controlTimeout limit how long an admin action waits for a busy handler
+const controlTimeout = 30 * time.Second
+
+// ServiceHandler is a handler controls incoming services info and talk to core through driver
 type ServiceHandler struct {
-	NodeID               uint64
-	NodeInfo             *models.Node
-	Tag                  string
-	handlerServiceClient modules.HandlerServiceClient
-	users                map[string]*models.User // Access worker public user pool
-	Services             []models.Service
-	ServicesChannel      <-chan []models.Service
-	WaitGroup            *sync.WaitGroup
-	lock                 *sync.RWMutex
+	NodeID          uint64
+	NodeInfo        *models.Node
+	Tag             string
+	driver          driver.Driver
+	users           map[string]*models.User // Access worker public user pool
+	Services        []models.Service
+	ServicesChannel <-chan ServiceBatch
+	NodeChannel     <-chan *models.Node
+	WaitGroup       *sync.WaitGroup
+	reapply         chan struct{} // core lost its state, e.g. restarted by supervisor
+	done            chan struct{} // closed when handler returns
+	stop            chan struct{} // closed by Stop, ends retries of a failed start
+	initialized     bool          // single inbound was added to core, if node needs it
+	control         chan *userCommand
+	latest          []models.Service  // last services from backend
+	suspended       map[string]bool   // users kept out of core by admin
+	failures        map[string]string // users core refused, with error
+	states          []ServiceState    // published for admin API
+	tags            []string          // inbounds applied to core, published for stats
+	Audit           *audit.Logger     // every change to core is recorded, nil disables it
+	cycle           string            // poll whose services are being applied, empty otherwise
+	revision        string            // backend revision of services being applied, empty otherwise
+	log             *logrus.Entry     // handlerLog with cycle_id of batch being applied
+	statesLock      sync.RWMutex
+	lock            *sync.RWMutex
+}
+
+// ServiceState is a service with whether it is applied to core
+type ServiceState struct {
+	models.Service
+	State string `json:"state"` // applied, failed or suspended
+	Error string `json:"error,omitempty"`
+}
+
+// userCommand is an admin action on a single user, run by handler goroutine
+type userCommand struct {
+	op    string // kick, suspend or resume
+	email string
+	done  chan error
 }
 
 // NewServiceHandler return a pointer to service handler using provided info
 func NewServiceHandler(nodeID uint64,
 	nodeInfo *models.Node,
-	hc modules.HandlerServiceClient,
-	schan <-chan []models.Service) *ServiceHandler {
+	d driver.Driver,
+	schan <-chan ServiceBatch) *ServiceHandler {
 	return &ServiceHandler{
-		NodeID:               nodeID,
-		NodeInfo:             nodeInfo,
-		handlerServiceClient: hc,
-		users:                userPool, // userpool shared within worker package
-		Services:             make([]models.Service, 0),
-		ServicesChannel:      schan,
-		lock:                 &userPoolLock,
+		NodeID:          nodeID,
+		NodeInfo:        nodeInfo,
+		driver:          d,
+		users:           userPool, // userpool shared within worker package
+		Services:        make([]models.Service, 0),
+		ServicesChannel: schan,
+		reapply:         make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		stop:            make(chan struct{}),
+		control:         make(chan *userCommand),
+		suspended:       make(map[string]bool),
+		failures:        make(map[string]string),
+		log:             handlerLog,
+		lock:            &userPoolLock,
+	}
+}
+
+// Control run an admin action on user with email and wait for it
+// kick drops a user from core and adds it again, suspend keeps it out until resume
+func (h *ServiceHandler) Control(op string, email string) error {
+	switch op {
+	case "kick", "suspend", "resume":
+	default:
+		return errors.New("unknown action " + op)
+	}
+	cmd := &userCommand{op: op, email: email, done: make(chan error, 1)}
+	select {
+	case h.control <- cmd:
+	case <-time.After(controlTimeout):
+		return errors.New("service handler busy")
+	}
+	// A command that panicked handler never answers
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-time.After(controlTimeout):
+		return errors.New("service handler did not finish " + op)
+	}
+}
+
+// InboundTags return tags of inbounds applied to core
+func (h *ServiceHandler) InboundTags() []string {
+	h.statesLock.RLock()
+	defer h.statesLock.RUnlock()
+	return append([]string(nil), h.tags...)
+}
+
+// States return services handler knows about and their apply state
+func (h *ServiceHandler) States() []ServiceState {
+	h.statesLock.RLock()
+	defer h.statesLock.RUnlock()
+	return append([]ServiceState(nil), h.states...)
+}
+
+// Reapply ask handler to apply inbounds and users again, for a core started from scratch
+func (h *ServiceHandler) Reapply() {
+	select {
+	case h.reapply <- struct{}{}:
+	default: // one pending request is enough
 	}
+	return
 }
 
 // Start start a instance
 func (h *ServiceHandler) Start() {
 	h.WaitGroup.Add(1)
-	go h.syncServices()
-	utils.Log.Info("ServiceHandler Started")
+	go func() {
+		defer close(h.done)
+		supervise("ServiceHandler", handlerLog, h.stop, h.run)
+	}()
+	handlerLog.Info("ServiceHandler Started")
 	return
 }
 
 // Stop stop a instance
+// handler returns once ServicesChannel is closed, a batch being applied is finished first
 func (h *ServiceHandler) Stop() {
+	close(h.stop)
+	<-h.done
 	h.WaitGroup.Done()
 	return
 }
 
+// run add single inbound to core once, then apply services until ServicesChannel is closed
+// a core refusing the inbound panics run, so supervise tries it again with backoff
+func (h *ServiceHandler) run() {
+	if !h.initialized && !h.NodeInfo.HasMultiPort {
+		select {
+		case <-h.stop:
+			return
+		default:
+		}
+		if err := h.initializeSingleInbound(); err != nil {
+			panic(err)
+		}
+	}
+	h.initialized = true
+	h.syncServices()
+	return
+}
+
+// syncServices apply what backend and admin send until ServicesChannel is closed
+// handler state lives in h, so a restarted loop goes on from where it panicked
 func (h *ServiceHandler) syncServices() {
+	// Mode is decided on every batch, since node settings may change at runtime
+	for {
+		h.cycle, h.revision, h.log = "", "", handlerLog
+		select {
+		case node, ok := <-h.NodeChannel:
+			if !ok {
+				h.NodeChannel = nil
+				continue
+			}
+			if nodeSettingsChanged(h.NodeInfo, node) {
+				h.rebuildInbounds(node)
+			}
+		case <-h.reapply:
+			h.applyInbounds(audit.ReasonDriftRepair)
+		case cmd := <-h.control:
+			cmd.done <- h.runCommand(cmd)
+		case batch, ok := <-h.ServicesChannel:
+			if !ok {
+				return
+			}
+			h.setCycle(batch.Cycle)
+			h.revision = batch.Revision
+			h.latest = batch.Services
+			h.apply(batch.Services, "")
+		}
+		h.publish()
+		agentStatus.beat("ServiceHandler")
+	}
+}
+
+// revisionOf return revision of services b listed last, empty if b does not version its data
+// it must be read right after listing, before services are listed again
+func revisionOf(b backend.Backend) string {
+	if r, ok := b.(backend.Revisioner); ok {
+		return r.Revision()
+	}
+	return ""
+}
+
+// setCycle tag logs and audit of what is applied next with ID of poll it came from
+func (h *ServiceHandler) setCycle(cycle string) {
+	h.cycle, h.log = cycle, handlerLog
+	if cycle != "" {
+		h.log = handlerLog.WithField("cycle_id", cycle)
+	}
+	return
+}
+
+// apply bring core in line with services, leaving out suspended users
+// changes are audited with reason, or with reason of each change if it is empty
+// expired services are left out as well, so they are removed even if backend still lists them
+func (h *ServiceHandler) apply(services []models.Service, reason string) {
+	now := time.Now()
+	allowed := make([]models.Service, 0, len(services))
+	for i := range services {
+		if !h.suspended[services[i].Email] && !expired(&services[i], now) {
+			allowed = append(allowed, services[i])
+		}
+	}
+	services = allowed
 	if h.NodeInfo.HasMultiPort {
-		h.syncServicesMultiInbound()
-		return
+		h.syncServicesMultiInbound(services, reason)
+	} else {
+		h.syncServicesSingleInbound(services, reason)
+	}
+	return
+}
+
+func (h *ServiceHandler) runCommand(cmd *userCommand) error {
+	switch cmd.op {
+	case "suspend":
+		h.suspended[cmd.email] = true
+	case "resume":
+		if !h.suspended[cmd.email] {
+			return errors.New("user " + cmd.email + " is not suspended")
+		}
+		delete(h.suspended, cmd.email)
+	case "kick":
+		j := -1
+		for i := range h.Services {
+			if h.Services[i].Email == cmd.email {
+				j = i
+				break
+			}
+		}
+		if j == -1 {
+			return errors.New("user " + cmd.email + " is not applied")
+		}
+		var err error
+		if h.NodeInfo.HasMultiPort {
+			err = h.removeInbound(utils.ServiceTag(&h.Services[j]), cmd.email, audit.ReasonAdminPrefix+cmd.op)
+		} else {
+			err = h.delUser(cmd.email, audit.ReasonAdminPrefix+cmd.op)
+		}
+		if err != nil {
+			return err
+		}
+		h.Services = append(h.Services[:j], h.Services[j+1:]...)
+	}
+	handlerLog.WithField("email", cmd.email).Infof("User %s By Admin", strings.Title(cmd.op))
+	h.apply(h.latest, audit.ReasonAdminPrefix+cmd.op)
+	return nil
+}
+
+// publish copy apply state of services for admin API
+func (h *ServiceHandler) publish() {
+	states := make([]ServiceState, 0, len(h.Services)+len(h.suspended))
+	applied := make(map[string]bool, len(h.Services))
+	for i := range h.Services {
+		applied[h.Services[i].Email] = true
+		state := ServiceState{Service: h.Services[i], State: "applied"}
+		if err, failed := h.failures[h.Services[i].Email]; failed { // core did not let it go
+			state.State, state.Error = "failed", err
+		}
+		states = append(states, state)
 	}
-	h.syncServicesSingleInbound()
+	for i := range h.latest {
+		email := h.latest[i].Email
+		if h.suspended[email] {
+			states = append(states, ServiceState{Service: h.latest[i], State: "suspended"})
+		} else if err, failed := h.failures[email]; failed && !applied[email] { // core did not take it
+			states = append(states, ServiceState{Service: h.latest[i], State: "failed", Error: err})
+		}
+	}
+	tags := []string{h.Tag}
+	if h.NodeInfo.HasMultiPort {
+		tags = make([]string, 0, len(h.Services))
+		for i := range h.Services {
+			tags = append(tags, utils.ServiceTag(&h.Services[i]))
+		}
+	}
+	h.statesLock.Lock()
+	h.states = states
+	h.tags = tags
+	h.statesLock.Unlock()
 	return
 }
 
-func (h *ServiceHandler) syncServicesMultiInbound() {
-	for services := range h.ServicesChannel {
-		// Calculate Services to add
-		ServicesToAdd := sub(services, h.Services).([]models.Service)
-		// Calculate Services to remove
-		ServicesToDel := sub(h.Services, services).([]models.Service)
+func (h *ServiceHandler) syncServicesMultiInbound(services []models.Service, reason string) {
+	// Calculate Services to add
+	ServicesToAdd := sub(services, h.Services).([]models.Service)
+	// Calculate Services to remove
+	ServicesToDel := sub(h.Services, services).([]models.Service)
+
+	// Perform add and delete
+	for i, s := range ServicesToAdd {
+		if err := h.addServiceInbound(&s, reasonOr(reason, audit.ReasonNewService)); err != nil {
+			h.log.WithError(err).Errorf("Error Adding Inbound Of %s", s.Email)
+			h.failures[s.Email] = err.Error()
+			continue
+		}
+		delete(h.failures, s.Email)
+		h.Services = append(h.Services, ServicesToAdd[i])
+	}
+	for i, s := range ServicesToDel {
+		if err := h.removeInbound(utils.ServiceTag(&s), s.Email, reasonOr(reason, removalReason(&s, false))); err != nil {
+			h.log.WithError(err).Errorf("Error Removing Inbound Of %s", s.Email)
+			h.failures[s.Email] = err.Error()
+			continue
+		}
+		delete(h.failures, s.Email)
+		j := findServiceIndex(&ServicesToDel[i], h.Services)
+		h.Services = append(h.Services[:j], h.Services[j+1:]...)
+	}
+	agentStatus.applied(len(h.Services), len(h.Services))
+	return
+}
+
+func (h *ServiceHandler) syncServicesSingleInbound(services []models.Service, reason string) {
+	// Calculate Services to add
+	ServicesToAdd := sub(services, h.Services).([]models.Service)
+	// Calculate Services to remove
+	ServicesToDel := sub(h.Services, services).([]models.Service)
+
+	// Deal with users excceeded their traffic
+	var tmp []models.Service
+	// Filter ServiceToAdd, services of users not in pool are left out until poller refreshes users
+	for i := range ServicesToAdd {
+		max, current, known := h.trafficOf(ServicesToAdd[i].Email)
+		if !known {
+			h.log.WithField("email", ServicesToAdd[i].Email).Warn("Service Of Unknown User Skipped")
+			continue
+		}
+		if max >= current {
+			tmp = append(tmp, ServicesToAdd[i])
+		}
+	}
+	ServicesToAdd = tmp
+	// Add to ServiceToDel, unless it is already removed from backend
+	removed := make(map[string]bool)
+	for i := range ServicesToDel {
+		removed[ServicesToDel[i].Email] = true
+	}
+	overQuota := make(map[string]bool)
+	for i := range h.Services {
+		if max, current, known := h.trafficOf(h.Services[i].Email); known && max <= current && !removed[h.Services[i].Email] {
+			ServicesToDel = append(ServicesToDel, h.Services[i])
+			overQuota[h.Services[i].Email] = true
+		}
+	}
 
-		// Perform add and delete
-		for i, s := range ServicesToAdd {
-			_ = h.handlerServiceClient.AddInbound(utils.ConvertVmessInbound(&s))
-			h.Services = append(h.Services, ServicesToAdd[i])
+	// Perform add and delete, driver converts services into users of its core
+	// A service is only applied once core took it, so a failed one is tried again next time
+	for i, s := range ServicesToAdd {
+		if err := h.addUser(&s, reasonOr(reason, audit.ReasonNewService)); err != nil {
+			h.log.WithError(err).Errorf("Error Adding User %s", s.Email)
+			h.failures[s.Email] = err.Error()
+			continue
 		}
-		for i, s := range ServicesToDel {
-			j := findServiceIndex(&ServicesToDel[i], h.Services)
-			_ = h.handlerServiceClient.RemoveInbound(string(s.ID))
-			h.Services = append(h.Services[:j], h.Services[j+1:]...)
+		delete(h.failures, s.Email)
+		h.log.Infof("Successfully Added User %s", s.Email)
+		h.Services = append(h.Services, ServicesToAdd[i])
+	}
+	for i, s := range ServicesToDel {
+		if err := h.delUser(s.Email, reasonOr(reason, removalReason(&s, overQuota[s.Email]))); err != nil {
+			h.log.WithError(err).Errorf("Error Deleting User %s", s.Email)
+			h.failures[s.Email] = err.Error()
+			continue
 		}
+		delete(h.failures, s.Email)
+		h.log.Infof("Successfully Deleted User %s", s.Email)
+		j := findServiceIndex(&ServicesToDel[i], h.Services)
+		h.Services = append(h.Services[:j], h.Services[j+1:]...)
+	}
+	agentStatus.applied(len(h.Services), 1)
+	return
+}
+
+// expired report whether s is past its expire time
+func expired(s *models.Service, now time.Time) bool {
+	return !s.ExpireAt.IsZero() && !now.Before(s.ExpireAt)
+}
+
+// removalReason tell why applied service s is removed, expiry goes before quota
+func removalReason(s *models.Service, overQuota bool) string {
+	switch {
+	case expired(s, time.Now()):
+		return audit.ReasonExpired
+	case overQuota:
+		return audit.ReasonQuotaExceeded
+	default:
+		return audit.ReasonServiceRemoved
+	}
+}
+
+// reasonOr return reason if set, fallback otherwise
+func reasonOr(reason string, fallback string) string {
+	if reason != "" {
+		return reason
+	}
+	return fallback
+}
+
+// trafficOf return quota and used traffic of user with email, known is false if user is not in pool
+func (h *ServiceHandler) trafficOf(email string) (max uint64, current uint64, known bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	u, found := h.users[email]
+	if !found || u == nil {
+		return 0, 0, false
 	}
+	return u.MaxTraffic, u.CurrentTraffic, true
 }
 
-func (h *ServiceHandler) syncServicesSingleInbound() {
-	// Init
-	if err := h.initializeSingleInbound(); err != nil {
-		utils.Log.Fatal("Error Initializing Single Inbound RayAgent")
+// rebuildInbounds tear down inbounds built for old node settings and build them for new ones
+// services already applied are attached again, so users stay online across the switch
+func (h *ServiceHandler) rebuildInbounds(node *models.Node) {
+	// Validate every inbound new settings need before touching core
+	if err := h.checkInbounds(node); err != nil {
+		handlerLog.WithError(err).Error("Rejected New Node Settings, Keeping Current Inbounds")
+		agentStatus.failed(err)
 		return
 	}
 
-	// Start listening []Services from channel
-	for services := range h.ServicesChannel {
-		// Calculate Services to add
-		ServicesToAdd := sub(services, h.Services).([]models.Service)
-		// Calculate Services to remove
-		ServicesToDel := sub(h.Services, services).([]models.Service)
+	old := h.NodeInfo
+	h.removeInbounds()
+	h.NodeInfo = node
+	if err := h.applyInbounds(audit.ReasonNodeSettings); err != nil {
+		// Core refused what passed validation, go back to inbounds it took before
+		handlerLog.WithError(err).Error("Error Rebuilding Inbounds, Restoring Old Node Settings")
+		h.removeInbounds()
+		h.NodeInfo = old
+		h.applyInbounds(audit.ReasonNodeSettings)
+		return
+	}
+	handlerLog.Info("Inbounds Rebuilt")
+	return
+}
 
-		// Deal with users excceeded their traffic
-		var tmp []models.Service
-		// Filter ServiceToAdd
-		for i := range ServicesToAdd {
-			if h.users[ServicesToAdd[i].Email].MaxTraffic >= h.users[ServicesToAdd[i].Email].CurrentTraffic {
-				tmp = append(tmp, ServicesToAdd[i])
-			}
+// checkInbounds report whether every inbound node needs can be built
+// a service with its own inbound must pass too, in multi inbound mode
+func (h *ServiceHandler) checkInbounds(node *models.Node) error {
+	if !node.HasMultiPort {
+		return h.driver.CheckNode(node)
+	}
+	for i := range h.Services {
+		if err := h.driver.CheckService(&h.Services[i]); err != nil {
+			return fmt.Errorf("Error Checking Inbound Of %s: %w", h.Services[i].Email, err)
 		}
-		ServicesToAdd = tmp
-		// Add to ServiceToDel
+	}
+	return nil
+}
+
+// removeInbounds remove every inbound built for current node settings
+func (h *ServiceHandler) removeInbounds() {
+	if h.NodeInfo.HasMultiPort {
 		for i := range h.Services {
-			if h.users[h.Services[i].Email].MaxTraffic <= h.users[h.Services[i].Email].CurrentTraffic {
-				ServicesToDel = append(ServicesToDel, h.Services[i])
+			if err := h.removeInbound(utils.ServiceTag(&h.Services[i]), h.Services[i].Email, audit.ReasonNodeSettings); err != nil {
+				handlerLog.WithError(err).Warnf("Error Removing Inbound Of %s", h.Services[i].Email)
 			}
 		}
+		return
+	}
+	if err := h.removeInbound(h.Tag, "", audit.ReasonNodeSettings); err != nil {
+		handlerLog.WithError(err).Warn("Error Removing Inbound")
+	}
+	return
+}
 
-		// Convert Services into v2ray user
-		UsersToAdd := make([]protocol.User, 0)
-		for _, s := range ServicesToAdd {
-			UsersToAdd = append(UsersToAdd, *utils.ConvertService(&s))
-		}
-		UsersToDel := make([]protocol.User, 0)
-		for _, s := range ServicesToDel {
-			UsersToDel = append(UsersToDel, *utils.ConvertService(&s))
-		}
-		// Perform add and delete
-		for i, u := range UsersToAdd {
-			if err := h.handlerServiceClient.AddUser(&u); err != nil {
-				utils.Log.Errorf("Error Adding User %s", u.Email)
+// applyInbounds add inbounds and users of every applied service to core, audited with reason
+// error is returned only if inbound shared by all services cannot be added
+func (h *ServiceHandler) applyInbounds(reason string) error {
+	if h.NodeInfo.HasMultiPort {
+		for i := range h.Services {
+			if err := h.addServiceInbound(&h.Services[i], reason); err != nil {
+				handlerLog.WithError(err).Errorf("Error Adding Inbound Of %s", h.Services[i].Email)
 			}
-			utils.Log.Infof("Successfully Added User %s", u.Email)
-			h.Services = append(h.Services, ServicesToAdd[i])
 		}
-		for i, u := range UsersToDel {
-			j := findServiceIndex(&ServicesToDel[i], h.Services)
-			if err := h.handlerServiceClient.DelUser(u.Email); err != nil {
-				utils.Log.Errorf("Error Deleting User %s", u.Email)
-			}
-			utils.Log.Infof("Successfully Deleted User %s", u.Email)
-			h.Services = append(h.Services[:j], h.Services[j+1:]...)
+		agentStatus.applied(len(h.Services), len(h.Services))
+		return nil
+	}
+	if err := h.addNodeInbound(reason); err != nil {
+		handlerLog.WithError(err).Error("Error Adding Inbound")
+		agentStatus.failed(err)
+		return err
+	}
+	for i := range h.Services {
+		if err := h.addUser(&h.Services[i], reason); err != nil {
+			handlerLog.WithError(err).Errorf("Error Adding User %s", h.Services[i].Email)
 		}
-
 	}
-	return
+	agentStatus.applied(len(h.Services), 1)
+	return nil
 }
 
 func (h *ServiceHandler) initializeSingleInbound() error {
-	// Clear target inbound
-	if err := h.handlerServiceClient.RemoveInbound(h.Tag); err != nil {
-		utils.Log.WithFields(logrus.Fields{
+	// Clear target inbound, a core started from scratch has none
+	if err := h.removeInbound(h.Tag, "", audit.ReasonStartup); err != nil {
+		handlerLog.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Error Removing Inbound")
-		return err
+		}).Warn("Error Removing Inbound")
 	}
 
 	// ReAdd inbound
-	inboundHandlerConfig, err := h.genVmessInbound()
-	if err != nil {
-		utils.Log.WithFields(logrus.Fields{
+	if err := h.driver.CheckNode(h.NodeInfo); err != nil {
+		handlerLog.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Error Generating VmessInbound")
+		}).Error("Error Generating Inbound")
 		return err
 	}
-	if err = h.handlerServiceClient.AddInbound(inboundHandlerConfig); err != nil {
-		utils.Log.WithFields(logrus.Fields{
+	if err := h.addNodeInbound(audit.ReasonStartup); err != nil {
+		handlerLog.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("Error Adding Inbound")
 		return errors.New("Error Adding Inbound")
@@ -306,79 +780,12 @@ func (h *ServiceHandler) initializeSingleInbound() error {
 	return nil
 }
 
-// genVmessInbound generate a vmess inbound with NO USER
-func (h *ServiceHandler) genVmessInbound() (*core.InboundHandlerConfig, error) {
-	// Get port from nodeinfo and validate
-	port, err := net.PortFromInt(uint32(h.NodeInfo.Port))
-	if err != nil {
-		utils.Log.WithFields(logrus.Fields{
-			"error": err.Error(),
-			"port":  h.NodeInfo.Port,
-		}).Error("Invalid Port")
-		return nil, errors.New("Invalid Port")
-	}
-
-	// Validate protocol
-	if !isProtocolValid(h.NodeInfo.VmessSetting.StreamSettings.TransportProtocol) {
-		utils.Log.WithFields(logrus.Fields{
-			"protocol": h.NodeInfo.TransportProtocol,
-		}).Error("Invalid Protocol")
-		return nil, errors.New("Invalid Protocol")
-	}
-	config := &core.InboundHandlerConfig{
-		Tag: h.Tag,
-		ReceiverSettings: serial.ToTypedMessage(
-			&proxyman.ReceiverConfig{
-				PortRange: net.SinglePortRange(port),
-				Listen:    net.NewIPOrDomain(net.ParseAddress("0.0.0.0")), // hard coded
-				AllocationStrategy: &proxyman.AllocationStrategy{
-					Type: proxyman.AllocationStrategy_Always,
-				}, // Must have
-				StreamSettings: &internet.StreamConfig{
-					//Protocol:     internet.TransportProtocol(internet.TransportProtocol_value[h.NodeInfo.VmessSetting.StreamSettings.TransportProtocol]), // Deprecated
-					ProtocolName: h.NodeInfo.VmessSetting.StreamSettings.TransportProtocol,
-					TransportSettings: []*internet.TransportConfig{&internet.TransportConfig{
-						//Protocol:     internet.TransportProtocol(internet.TransportProtocol_value[h.NodeInfo.VmessSetting.StreamSettings.TransportProtocol]), // Deprecated
-						ProtocolName: h.NodeInfo.VmessSetting.StreamSettings.TransportProtocol,
-						Settings: serial.ToTypedMessage(&websocket.Config{
-							Path: "", // leave for future
-						}),
-					}},
-				},
-				ReceiveOriginalDestination: true,
-				SniffingSettings: &proxyman.SniffingConfig{
-					Enabled:             true,
-					DestinationOverride: []string{"http", "tls"},
-				},
-			},
-		),
-		ProxySettings: serial.ToTypedMessage(
-			&vmessInbound.Config{
-				User: []*protocol.User{},
-				Default: &vmessInbound.DefaultConfig{
-					AlterId: 64, // hard coded
-				},
-				//Detour: &vmessInbound.DetourConfig{
-				//	To: "", // No detour, not support yet
-				//},
-				SecureEncryptionOnly: true,
-			},
-		),
-	}
-	return config, nil
-}
-
-func isProtocolValid(p string) bool {
-	var validprotocol map[string]bool = map[string]bool{
-		"tcp":          true,
-		"websocket":    true,
-		"http":         true,
-		"mkcp":         true,
-		"domainsocket": true,
-		"quic":         true,
-	}
-	_, found := validprotocol[p]
-	return found
+// nodeSettingsChanged report whether inbounds need to be rebuilt
+// traffic counters change all the time and are ignored
+func nodeSettingsChanged(old *models.Node, new *models.Node) bool {
+	return old.HasMultiPort != new.HasMultiPort ||
+		old.HasUDP != new.HasUDP ||
+		!reflect.DeepEqual(old.Settings, new.Settings)
 }
 
 func findServiceIndex(s *models.Service, array []models.Service) int {
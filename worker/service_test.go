@@ -0,0 +1,328 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coolray-dev/rayagent/audit"
+	"github.com/coolray-dev/rayagent/models"
+)
+
+func testService(id uint64, email string) models.Service {
+	s := models.Service{ID: id, Port: 10000 + uint(id)}
+	s.Email = email
+	return s
+}
+
+func testHandler(d *fakeDriver, node *models.Node, applied ...models.Service) *ServiceHandler {
+	h := NewServiceHandler(1, node, d, nil)
+	h.Tag = "rayagent"
+	h.Services = append(h.Services, applied...)
+	return h
+}
+
+func emailsOf(services []models.Service) []string {
+	emails := []string{}
+	for i := range services {
+		emails = append(emails, services[i].Email)
+	}
+	return emails
+}
+
+func TestSyncServicesSingleInbound(t *testing.T) {
+	a, b, c := testService(1, "a@example.com"), testService(2, "b@example.com"), testService(3, "c@example.com")
+	tests := []struct {
+		name     string
+		users    []models.User
+		applied  []models.Service
+		services []models.Service
+		fail     map[string]error
+		ops      []string
+		want     []string
+		failed   []string
+	}{
+		{
+			name:     "new services are added",
+			users:    []models.User{testUser(a.Email, 100, 0), testUser(b.Email, 100, 0)},
+			services: []models.Service{a, b},
+			ops:      []string{"add_user a@example.com", "add_user b@example.com"},
+			want:     []string{a.Email, b.Email},
+		},
+		{
+			name:     "services of unknown users are skipped",
+			users:    []models.User{testUser(a.Email, 100, 0)},
+			services: []models.Service{a, b},
+			ops:      []string{"add_user a@example.com"},
+			want:     []string{a.Email},
+		},
+		{
+			name:     "users over quota are not added",
+			users:    []models.User{testUser(a.Email, 100, 0), testUser(b.Email, 100, 200)},
+			services: []models.Service{a, b},
+			ops:      []string{"add_user a@example.com"},
+			want:     []string{a.Email},
+		},
+		{
+			name:     "services gone from backend are removed",
+			users:    []models.User{testUser(a.Email, 100, 0), testUser(b.Email, 100, 0)},
+			applied:  []models.Service{a, b},
+			services: []models.Service{a},
+			ops:      []string{"del_user b@example.com"},
+			want:     []string{a.Email},
+		},
+		{
+			name:     "applied users reaching quota are removed",
+			users:    []models.User{testUser(a.Email, 100, 100), testUser(b.Email, 100, 0)},
+			applied:  []models.Service{a, b},
+			services: []models.Service{a, b},
+			ops:      []string{"del_user a@example.com"},
+			want:     []string{b.Email},
+		},
+		{
+			name:     "users core refuses are not applied",
+			users:    []models.User{testUser(a.Email, 100, 0), testUser(c.Email, 100, 0)},
+			services: []models.Service{a, c},
+			fail:     map[string]error{"add_user c@example.com": errors.New("refused")},
+			ops:      []string{"add_user a@example.com", "add_user c@example.com"},
+			want:     []string{a.Email},
+			failed:   []string{c.Email},
+		},
+		{
+			name:     "users core refuses to remove stay applied",
+			users:    []models.User{testUser(a.Email, 100, 0), testUser(b.Email, 100, 0)},
+			applied:  []models.Service{a, b},
+			services: []models.Service{a},
+			fail:     map[string]error{"del_user b@example.com": errors.New("refused")},
+			ops:      []string{"del_user b@example.com"},
+			want:     []string{a.Email, b.Email},
+			failed:   []string{b.Email},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUserPool(tt.users...)
+			d := newFakeDriver()
+			for op, err := range tt.fail {
+				d.fail[op] = err
+			}
+			h := testHandler(d, &models.Node{}, tt.applied...)
+
+			h.syncServicesSingleInbound(tt.services, "")
+
+			if !reflect.DeepEqual(d.ops, tt.ops) {
+				t.Errorf("ops = %v, want %v", d.ops, tt.ops)
+			}
+			if got := emailsOf(h.Services); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applied = %v, want %v", got, tt.want)
+			}
+			for _, email := range tt.failed {
+				if _, found := h.failures[email]; !found {
+					t.Errorf("%s not recorded as failed", email)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncServicesRetriesFailed(t *testing.T) {
+	a := testService(1, "a@example.com")
+	setUserPool(testUser(a.Email, 100, 0))
+	d := newFakeDriver()
+	d.fail["add_user a@example.com"] = errors.New("refused")
+	h := testHandler(d, &models.Node{})
+	h.latest = []models.Service{a}
+
+	h.syncServicesSingleInbound([]models.Service{a}, "")
+	h.publish()
+	if states := h.States(); len(states) != 1 || states[0].State != "failed" {
+		t.Errorf("states = %+v, want a@example.com failed", states)
+	}
+
+	delete(d.fail, "add_user a@example.com")
+	h.syncServicesSingleInbound([]models.Service{a}, "")
+	h.publish()
+	if got := emailsOf(h.Services); !reflect.DeepEqual(got, []string{a.Email}) {
+		t.Errorf("applied = %v, want failed service added on next sync", got)
+	}
+	if states := h.States(); len(states) != 1 || states[0].State != "applied" {
+		t.Errorf("states = %+v, want a@example.com applied", states)
+	}
+}
+
+func TestRemovalReason(t *testing.T) {
+	expiredService := testService(1, "a@example.com")
+	expiredService.ExpireAt = time.Now().Add(-time.Hour)
+	activeService := testService(2, "b@example.com")
+	activeService.ExpireAt = time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		service   models.Service
+		overQuota bool
+		want      string
+	}{
+		{"expired goes before quota", expiredService, true, audit.ReasonExpired},
+		{"over quota", activeService, true, audit.ReasonQuotaExceeded},
+		{"removed from backend", activeService, false, audit.ReasonServiceRemoved},
+		{"never expires", testService(3, "c@example.com"), false, audit.ReasonServiceRemoved},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := removalReason(&tt.service, tt.overQuota); got != tt.want {
+				t.Errorf("removalReason() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditRecordsBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rayagent-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger, err := audit.NewLogger(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	setUserPool(testUser("a@example.com", 100, 0), testUser("b@example.com", 100, 0))
+	schan := make(chan ServiceBatch, 2)
+	h := NewServiceHandler(1, &models.Node{}, newFakeDriver(), schan)
+	h.Tag = "rayagent"
+	h.Audit = logger
+	schan <- ServiceBatch{Services: []models.Service{testService(1, "a@example.com")}, Cycle: "cycle1", Revision: "rev1"}
+	schan <- ServiceBatch{Services: []models.Service{testService(2, "b@example.com")}, Cycle: "cycle2", Revision: "rev2"}
+	close(schan)
+	h.syncServices()
+
+	entries, err := logger.Query(audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []audit.Entry{
+		{Operation: audit.AddUser, Email: "a@example.com", Reason: audit.ReasonNewService, CycleID: "cycle1", Revision: "rev1"},
+		{Operation: audit.AddUser, Email: "b@example.com", Reason: audit.ReasonNewService, CycleID: "cycle2", Revision: "rev2"},
+		{Operation: audit.DelUser, Email: "a@example.com", Reason: audit.ReasonServiceRemoved, CycleID: "cycle2", Revision: "rev2"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		e := entries[i]
+		if e.Operation != want[i].Operation || e.Email != want[i].Email || e.Reason != want[i].Reason ||
+			e.CycleID != want[i].CycleID || e.Revision != want[i].Revision {
+			t.Errorf("entry %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestRebuildInbounds(t *testing.T) {
+	a, b := testService(1, "a@example.com"), testService(2, "b@example.com")
+	single := func(port uint) *models.Node {
+		n := &models.Node{}
+		n.Port = port
+		return n
+	}
+	multi := &models.Node{HasMultiPort: true}
+	tests := []struct {
+		name string
+		old  *models.Node
+		new  *models.Node
+		fail map[string]error
+		ops  []string
+		want *models.Node
+	}{
+		{
+			name: "single inbound moves to new port",
+			old:  single(1000),
+			new:  single(2000),
+			ops: []string{
+				"remove_inbound rayagent",
+				"add_inbound rayagent 2000",
+				"add_user a@example.com",
+				"add_user b@example.com",
+			},
+			want: single(2000),
+		},
+		{
+			name: "invalid node settings leave core untouched",
+			old:  single(1000),
+			new:  single(2000),
+			fail: map[string]error{"check_node 2000": errors.New("bad settings")},
+			want: single(1000),
+		},
+		{
+			name: "switch to multi inbound",
+			old:  single(1000),
+			new:  multi,
+			ops: []string{
+				"remove_inbound rayagent",
+				"add_inbound service-1",
+				"add_inbound service-2",
+			},
+			want: multi,
+		},
+		{
+			name: "a service that cannot have its own inbound blocks switch to multi inbound",
+			old:  single(1000),
+			new:  multi,
+			fail: map[string]error{"check_service b@example.com": errors.New("bad service")},
+			want: single(1000),
+		},
+		{
+			name: "switch back to single inbound",
+			old:  multi,
+			new:  single(2000),
+			ops: []string{
+				"remove_inbound service-1",
+				"remove_inbound service-2",
+				"add_inbound rayagent 2000",
+				"add_user a@example.com",
+				"add_user b@example.com",
+			},
+			want: single(2000),
+		},
+		{
+			name: "old inbound is restored if core refuses new one",
+			old:  single(1000),
+			new:  single(2000),
+			fail: map[string]error{"add_inbound rayagent 2000": errors.New("port in use")},
+			ops: []string{
+				"remove_inbound rayagent",
+				"add_inbound rayagent 2000",
+				"remove_inbound rayagent",
+				"add_inbound rayagent 1000",
+				"add_user a@example.com",
+				"add_user b@example.com",
+			},
+			want: single(1000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDriver()
+			for op, err := range tt.fail {
+				d.fail[op] = err
+			}
+			h := testHandler(d, tt.old, a, b)
+
+			h.rebuildInbounds(tt.new)
+
+			if !reflect.DeepEqual(d.ops, tt.ops) {
+				t.Errorf("ops = %v, want %v", d.ops, tt.ops)
+			}
+			if !reflect.DeepEqual(h.NodeInfo, tt.want) {
+				t.Errorf("node = %+v, want %+v", h.NodeInfo, tt.want)
+			}
+			if got := emailsOf(h.Services); !reflect.DeepEqual(got, []string{a.Email, b.Email}) {
+				t.Errorf("applied = %v, want both services kept", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+)
+
+// snapshotFile is where last known good state from raydash is kept
+const snapshotFile = "snapshot.json"
+
+// snapshot is the last known good state from raydash
+// it lets a node boot and serve users while raydash is down
+type snapshot struct {
+	SavedAt  time.Time        `json:"saved_at"`
+	Node     *models.Node     `json:"node"`
+	Users    []models.User    `json:"users"`
+	Services []models.Service `json:"services"`
+}
+
+// saveSnapshot persist node, current user pool and services to local state directory
+func saveSnapshot(node *models.Node, services []models.Service) error {
+	snap := snapshot{
+		SavedAt:  time.Now(),
+		Node:     node,
+		Services: services,
+	}
+	userPoolLock.RLock()
+	snap.Users = make([]models.User, 0, len(userPool))
+	for _, u := range userPool {
+		snap.Users = append(snap.Users, *u)
+	}
+	userPoolLock.RUnlock()
+	return modules.WriteState(snapshotFile, &snap)
+}
+
+// loadSnapshot read last known good state from local state directory
+func loadSnapshot() (*snapshot, error) {
+	var snap snapshot
+	if err := modules.ReadState(snapshotFile, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
@@ -1,37 +1,43 @@
 package worker
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
-	"net/http"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/coolray-dev/rayagent/backend"
+	"github.com/coolray-dev/rayagent/driver"
+	"github.com/coolray-dev/rayagent/metrics"
 	"github.com/coolray-dev/rayagent/models"
-	"github.com/coolray-dev/rayagent/modules"
-	"github.com/coolray-dev/rayagent/utils"
 )
 
-// StatsHandler is a handler get traffic stats from v2ray and report back to raydash
+// StatsHandler is a handler get traffic stats from core and report back to backend
 type StatsHandler struct {
-	NodeID             uint64
-	NodeInfo           *models.Node
-	statsServiceClient *modules.StatsServiceClient
-	users              map[string]*models.User
-	Ticker             *time.Ticker
-	Interval           uint64 // interval in second
-	StatsChannel       chan *models.Stats
-	WaitGroup          *sync.WaitGroup
-	lock               *sync.RWMutex
+	NodeID       uint64
+	NodeInfo     *models.Node
+	driver       driver.Driver
+	users        map[string]*models.User
+	Interval     uint64 // interval in second
+	StatsChannel chan *models.Stats
+	WaitGroup    *sync.WaitGroup
+	Inbounds     func() []string // tags of inbounds to count traffic of, may be nil
+	stop         chan struct{}
+	reset        chan uint64   // new Interval for running ticker
+	stopped      chan struct{} // closed when ticker goroutine returns
+	lock         *sync.RWMutex
 }
 
 // NewStatsHandler returns a ptr of StatsHandler instance
-func NewStatsHandler(sc *modules.StatsServiceClient) *StatsHandler {
+func NewStatsHandler(d driver.Driver) *StatsHandler {
 	return &StatsHandler{
-		users:              userPool,
-		statsServiceClient: sc,
-		lock:               &userPoolLock,
+		users:   userPool,
+		driver:  d,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		reset:   make(chan uint64, 1),
+		lock:    &userPoolLock,
 	}
 }
 
@@ -39,107 +45,298 @@ func NewStatsHandler(sc *modules.StatsServiceClient) *StatsHandler {
 func (s *StatsHandler) Start() {
 	s.WaitGroup.Add(1)
 	s.startTicker(s.getStats)
-	utils.Log.Info("StatsHandler Started")
+	statsLog.Info("StatsHandler Started")
 	return
 }
 
 // Stop do graceful shutdown and close the goroutine
+// traffic counted since last tick is sampled one more time, so it is not lost
+// StatsChannel may be closed once Stop returns
 func (s *StatsHandler) Stop() {
-	s.Ticker.Stop()
+	close(s.stop)
+	<-s.stopped
+	s.getStats()
 	s.WaitGroup.Done()
 	return
 }
 
+// SetInterval restart running ticker with new interval in second
+func (s *StatsHandler) SetInterval(interval uint64) {
+	if interval == s.Interval {
+		return
+	}
+	s.Interval = interval
+	s.reset <- interval
+	return
+}
+
 func (s *StatsHandler) getStats() {
-	s.lock.RLock()
-	for _, u := range s.users {
+	s.getUserStats()
+
+	// Inbound traffic is only exported, backend bills users
+	if s.Inbounds != nil {
+		for _, tag := range s.Inbounds() {
+			up, down, err := s.driver.GetInboundTraffic(tag)
+			if err != nil {
+				continue
+			}
+			metrics.InboundTraffic(tag, up, down)
+		}
+	}
+	statsLog.Debug("Successfully procceed all user stats")
+	return
+}
+
+// getUserStats send traffic of every user in pool to StatsChannel
+// pool is not locked while sending, StatsSender locks it to account what is sent
+func (s *StatsHandler) getUserStats() {
+	for _, email := range s.emails() {
 
 		var stats models.Stats
 		var err error
-		stats.Traffic, err = s.statsServiceClient.GetUserTraffic(u.Email)
+		stats.Uplink, stats.Downlink, err = s.driver.GetUserTraffic(email)
 		if err != nil {
 			continue
 		}
-		stats.Email = u.Email
+		stats.Traffic = stats.Uplink + stats.Downlink
+		stats.Email = email
 
 		s.StatsChannel <- &stats
 	}
-	s.lock.RUnlock()
-	utils.Log.Debug("Successfully procceed all user stats")
 	return
 }
 
+// emails return emails of users in pool
+// pool is unlocked by defer, so a panic does not leave it locked for other workers
+func (s *StatsHandler) emails() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	emails := make([]string, 0, len(s.users))
+	for _, u := range s.users {
+		emails = append(emails, u.Email)
+	}
+	return emails
+}
+
 func (s *StatsHandler) startTicker(worker func()) {
-	ticker := time.NewTicker(time.Second * time.Duration(s.Interval))
+	interval := s.Interval
 	go func() {
-		for range ticker.C {
-			worker()
-		}
+		defer close(s.stopped)
+		supervise("StatsHandler", statsLog, s.stop, func() {
+			ticker := time.NewTicker(time.Second * time.Duration(interval))
+			defer func() { ticker.Stop() }()
+			for {
+				select {
+				case <-s.stop:
+					return
+				case interval = <-s.reset:
+					ticker.Stop()
+					ticker = time.NewTicker(time.Second * time.Duration(interval))
+				case <-ticker.C:
+					worker()
+					agentStatus.beat("StatsHandler")
+				}
+			}
+		})
 	}()
-	s.Ticker = ticker
 	return
 }
 
-// StatsSender receive stats struct from channel and send it to raydash
+// Retry backoff of traffic in outbox
+const (
+	minOutboxRetry = 5 * time.Second
+	maxOutboxRetry = 5 * time.Minute
+)
+
+// StatsSender receive stats struct from channel and send it to backend
+// traffic backend did not take is kept in outbox and retried with backoff
 type StatsSender struct {
-	RayDashURL   string // e.g. https://raydash.example.com
 	Interval     uint64 // interval in second
 	Ticker       *time.Ticker
+	OutboxFile   string // outbox in state directory, kept across restarts, memory only if empty
 	users        map[string]*models.User
 	StatsChannel chan *models.Stats
 	WaitGroup    *sync.WaitGroup
 	lock         *sync.RWMutex
-	httpClient   *http.Client
+	backend      backend.Backend
+	outbox       *outbox
+	backoff      time.Duration // wait before next retry of outbox
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         chan struct{} // closed when every stats in channel is handled
 }
 
 // NewStatsSender returns a ptr of StatsSender instance
-func NewStatsSender() *StatsSender {
+func NewStatsSender(b backend.Backend) *StatsSender {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &StatsSender{
-		users:      userPool,
-		lock:       &userPoolLock,
-		httpClient: createHTTPClient(),
+		users:   userPool,
+		lock:    &userPoolLock,
+		backend: b,
+		outbox:  newOutbox(""),
+		backoff: minOutboxRetry,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
 	}
 }
 
 // Start start the instance
 func (s *StatsSender) Start() {
 	s.WaitGroup.Add(1)
-	go s.syncStats()
-	utils.Log.Info("StatsSender Started")
+	s.loadOutbox()
+	go func() {
+		defer close(s.done)
+		supervise("StatsSender", statsLog, nil, s.syncStats)
+	}()
+	statsLog.Info("StatsSender Started")
 	return
 }
 
-// Stop stop the instance
-func (s *StatsSender) Stop() {
+// Stop stop the instance, waiting for stats in channel to be reported until ctx is done
+// outbox is tried once more, what is left stays in OutboxFile for next run
+// StatsHandler must be stopped first, it writes to StatsChannel
+func (s *StatsSender) Stop(ctx context.Context) error {
 	close(s.StatsChannel)
-	s.WaitGroup.Done()
+	defer s.WaitGroup.Done()
+	select {
+	case <-s.done:
+		s.flush(ctx)
+	case <-ctx.Done():
+		// Abort report in flight, it goes to outbox
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+	if n := s.outbox.len(); n != 0 {
+		return fmt.Errorf("traffic of %d users not reported, kept in outbox", n)
+	}
+	return nil
+}
+
+// Pending return number of users with traffic waiting in outbox
+func (s *StatsSender) Pending() int {
+	return s.outbox.len()
+}
+
+// loadOutbox replace in-memory outbox with OutboxFile
+func (s *StatsSender) loadOutbox() {
+	if s.OutboxFile != "" {
+		s.outbox = newOutbox(s.OutboxFile)
+	}
 	return
 }
 
+// syncStats report stats in channel until it is closed, and retry outbox in between
+// a restarted loop goes on with what is left in channel
 func (s *StatsSender) syncStats() {
-	for stats := range s.StatsChannel {
-		// pull user
-		if stats.Traffic != 0 {
-			s.lock.Lock()
-			s.users[stats.Email].CurrentTraffic += stats.Traffic
-			s.lock.Unlock()
-
-			s.lock.RLock()
-			s.patchUser(s.users[stats.Email])
-			s.lock.RUnlock()
+	retry := time.NewTimer(s.backoff)
+	defer retry.Stop()
+	for {
+		select {
+		case stats, ok := <-s.StatsChannel:
+			if !ok {
+				return
+			}
+			agentStatus.beat("StatsSender")
+			if stats.Traffic == 0 {
+				continue
+			}
+			metrics.UserTraffic(stats.Email, stats.Uplink, stats.Downlink)
+			traffic, found := s.account(stats)
+			if !found {
+				continue
+			}
+			s.report(traffic)
+		case <-retry.C:
+			s.flush(s.ctx)
+			retry.Reset(s.backoff)
 		}
+	}
+}
 
+// report send traffic of a user, together with what outbox keeps for the user
+// so an older report of the user is never sent after a newer one
+func (s *StatsSender) report(traffic models.Traffic) {
+	pending, found := s.outbox.get(traffic.User.Email)
+	if found {
+		traffic = mergeTraffic(pending, traffic)
+	}
+	if err := s.backend.ReportTraffic(s.ctx, []models.Traffic{traffic}); err != nil {
+		statsLog.WithError(err).WithField("username", traffic.User.Username).Error("Error Reporting User Traffic")
+		agentStatus.failed(err)
+		s.outbox.replace(traffic) // pending is merged into traffic already
+		return
+	}
+	if found {
+		s.outbox.remove(traffic.User.Email)
 	}
+	metrics.Reported(time.Now())
+	return
 }
 
-func (s *StatsSender) patchUser(u *models.User) error {
-	jsonStr, _ := json.Marshal(u)
-	req, _ := http.NewRequest(http.MethodPatch, s.RayDashURL+"/users/"+u.Username, bytes.NewBuffer([]byte(jsonStr)))
-	req.Header.Set("Content-Type", "application/json")
+// flush report every traffic in outbox at once, backoff grows while backend refuses it
+func (s *StatsSender) flush(ctx context.Context) error {
+	pending := s.outbox.all()
+	if len(pending) == 0 {
+		s.backoff = minOutboxRetry
+		return nil
+	}
+	err := s.backend.ReportTraffic(ctx, pending)
+	var partial *backend.PartialReportError
+	if err != nil && !errors.As(err, &partial) {
+		if s.backoff *= 2; s.backoff > maxOutboxRetry {
+			s.backoff = maxOutboxRetry
+		}
+		statsLog.WithError(err).WithField("pending", len(pending)).Warnf("Error Reporting Traffic Outbox, Retrying In %s", s.backoff)
+		agentStatus.failed(err)
+		return err
+	}
 
-	resp, _ := s.httpClient.Do(req)
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("Error Sending API Call to" + s.RayDashURL + "/users/" + u.Username)
+	// Traffic backend left out stays for next retry
+	left := make(map[string]bool)
+	if partial != nil {
+		for i := range partial.Traffic {
+			left[partial.Traffic[i].User.Email] = true
+		}
+	}
+	emails := make([]string, 0, len(pending))
+	for i := range pending {
+		if !left[pending[i].User.Email] {
+			emails = append(emails, pending[i].User.Email)
+		}
 	}
+	s.outbox.remove(emails...)
+	if partial != nil {
+		if s.backoff *= 2; s.backoff > maxOutboxRetry {
+			s.backoff = maxOutboxRetry
+		}
+		statsLog.WithError(err).WithField("pending", len(left)).Warnf("Traffic Outbox Partly Reported, Retrying In %s", s.backoff)
+		agentStatus.failed(err)
+		if len(emails) != 0 {
+			metrics.Reported(time.Now())
+		}
+		return err
+	}
+	s.backoff = minOutboxRetry
+	metrics.Reported(time.Now())
+	statsLog.WithField("reported", len(pending)).Info("Traffic Outbox Reported")
 	return nil
 }
+
+// account add stats to traffic of its user in pool and return traffic to report
+func (s *StatsSender) account(stats *models.Stats) (models.Traffic, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u, found := s.users[stats.Email]
+	if !found || u == nil {
+		return models.Traffic{}, false
+	}
+	u.CurrentTraffic += stats.Traffic
+	return models.Traffic{
+		User:     *u,
+		Uplink:   stats.Uplink,
+		Downlink: stats.Downlink,
+		Time:     time.Now(),
+	}, true
+}
@@ -0,0 +1,205 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+func TestSyncStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		refusals int
+		stats    []models.Stats
+		reports  int               // traffic backend took
+		reported map[string]uint64 // uplink taken by email
+		current  map[string]uint64 // CurrentTraffic last reported by email
+		pending  map[string]uint64 // uplink left in outbox by email
+	}{
+		{
+			name: "every stats is reported",
+			stats: []models.Stats{
+				{Email: "a@example.com", Traffic: 30, Uplink: 10, Downlink: 20},
+				{Email: "b@example.com", Traffic: 5, Uplink: 5},
+				{Email: "a@example.com", Traffic: 3, Uplink: 1, Downlink: 2},
+			},
+			reports:  3,
+			reported: map[string]uint64{"a@example.com": 11, "b@example.com": 5},
+			current:  map[string]uint64{"a@example.com": 33, "b@example.com": 5},
+		},
+		{
+			name: "zero traffic and unknown users are not reported",
+			stats: []models.Stats{
+				{Email: "a@example.com"},
+				{Email: "nobody@example.com", Traffic: 5, Uplink: 5},
+			},
+			reported: map[string]uint64{},
+			current:  map[string]uint64{},
+		},
+		{
+			name:     "refused traffic goes with next report of user",
+			refusals: 1,
+			stats: []models.Stats{
+				{Email: "a@example.com", Traffic: 30, Uplink: 10, Downlink: 20},
+				{Email: "a@example.com", Traffic: 3, Uplink: 1, Downlink: 2},
+			},
+			reports:  1,
+			reported: map[string]uint64{"a@example.com": 11},
+			current:  map[string]uint64{"a@example.com": 33},
+		},
+		{
+			name:     "traffic backend never takes stays in outbox merged",
+			refusals: -1,
+			stats: []models.Stats{
+				{Email: "a@example.com", Traffic: 30, Uplink: 10, Downlink: 20},
+				{Email: "a@example.com", Traffic: 3, Uplink: 1, Downlink: 2},
+				{Email: "b@example.com", Traffic: 5, Uplink: 5},
+			},
+			reported: map[string]uint64{},
+			current:  map[string]uint64{},
+			pending:  map[string]uint64{"a@example.com": 11, "b@example.com": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUserPool(testUser("a@example.com", 1000, 0), testUser("b@example.com", 1000, 0))
+			b := &fakeBackend{refusals: tt.refusals}
+			s := NewStatsSender(b)
+			s.StatsChannel = make(chan *models.Stats, len(tt.stats))
+			for i := range tt.stats {
+				s.StatsChannel <- &tt.stats[i]
+			}
+			close(s.StatsChannel)
+
+			s.syncStats()
+
+			if len(b.reported) != tt.reports {
+				t.Errorf("backend took %d reports, want %d", len(b.reported), tt.reports)
+			}
+			uplink := make(map[string]uint64)
+			current := make(map[string]uint64)
+			for _, r := range b.reported {
+				uplink[r.User.Email] += r.Uplink
+				current[r.User.Email] = r.User.CurrentTraffic
+			}
+			for email, want := range tt.reported {
+				if uplink[email] != want {
+					t.Errorf("uplink of %s = %d, want %d", email, uplink[email], want)
+				}
+			}
+			for email, want := range tt.current {
+				if current[email] != want {
+					t.Errorf("current traffic of %s = %d, want %d", email, current[email], want)
+				}
+			}
+			pending := make(map[string]uint64)
+			for _, traffic := range s.outbox.all() {
+				pending[traffic.User.Email] = traffic.Uplink
+			}
+			if len(pending) != len(tt.pending) || s.Pending() != len(tt.pending) {
+				t.Errorf("pending = %v, want %v", pending, tt.pending)
+			}
+			for email, want := range tt.pending {
+				if pending[email] != want {
+					t.Errorf("uplink of %s in outbox = %d, want %d", email, pending[email], want)
+				}
+			}
+			if err := s.flush(context.Background()); (err != nil) != (tt.refusals < 0) {
+				t.Errorf("flush() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeTraffic(t *testing.T) {
+	older := models.Traffic{User: testUser("a@example.com", 100, 10), Uplink: 1, Downlink: 2}
+	newer := models.Traffic{User: testUser("a@example.com", 100, 30), Uplink: 3, Downlink: 4}
+	newer.Time = older.Time.Add(1)
+	for _, got := range []models.Traffic{mergeTraffic(older, newer), mergeTraffic(newer, older)} {
+		if got.Uplink != 4 || got.Downlink != 6 {
+			t.Errorf("merged traffic = %d/%d, want 4/6", got.Uplink, got.Downlink)
+		}
+		if got.User.CurrentTraffic != 30 {
+			t.Errorf("merged current traffic = %d, want 30 of newer report", got.User.CurrentTraffic)
+		}
+	}
+}
+
+func TestOutboxPut(t *testing.T) {
+	o := newOutbox("")
+	o.put([]models.Traffic{
+		{User: testUser("a@example.com", 100, 1), Uplink: 1},
+		{User: testUser("b@example.com", 100, 2), Uplink: 2},
+	})
+	o.put([]models.Traffic{{User: testUser("a@example.com", 100, 3), Uplink: 3}})
+
+	want := map[string]uint64{"a@example.com": 4, "b@example.com": 2}
+	got := make(map[string]uint64)
+	for _, traffic := range o.all() {
+		got[traffic.User.Email] = traffic.Uplink
+	}
+	if len(got) != len(want) || got["a@example.com"] != want["a@example.com"] || got["b@example.com"] != want["b@example.com"] {
+		t.Errorf("outbox = %v, want %v", got, want)
+	}
+}
+
+func TestStatsHandlerSampleManyUsers(t *testing.T) {
+	// More users with traffic than channel holds, sender accounts while handler sends
+	users := make([]models.User, 0, 30)
+	d := newFakeDriver()
+	for i := 0; i < 30; i++ {
+		email := fmt.Sprintf("user%d@example.com", i)
+		users = append(users, testUser(email, 1000, 0))
+		d.traffic[email] = [2]uint64{1, 1}
+	}
+	setUserPool(users...)
+	b := &fakeBackend{}
+	sender := NewStatsSender(b)
+	sender.StatsChannel = make(chan *models.Stats, 10)
+	handler := NewStatsHandler(d)
+	handler.StatsChannel = sender.StatsChannel
+
+	done := make(chan struct{})
+	go func() {
+		sender.syncStats()
+		close(done)
+	}()
+	sampled := make(chan struct{})
+	go func() {
+		handler.getStats()
+		close(sender.StatsChannel)
+		close(sampled)
+	}()
+	select {
+	case <-sampled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler and sender are stuck on each other")
+	}
+	<-done
+	if len(b.reported) != len(users) {
+		t.Errorf("backend took %d reports, want %d", len(b.reported), len(users))
+	}
+}
+
+func TestFlushPartialReport(t *testing.T) {
+	b := &fakeBackend{unknown: map[string]bool{"b@example.com": true}}
+	s := NewStatsSender(b)
+	s.outbox.put([]models.Traffic{
+		{User: testUser("a@example.com", 100, 1), Uplink: 1},
+		{User: testUser("b@example.com", 100, 2), Uplink: 2},
+	})
+
+	if err := s.flush(context.Background()); err == nil {
+		t.Error("flush() reported no error for traffic backend left out")
+	}
+	if len(b.reported) != 1 || b.reported[0].User.Email != "a@example.com" {
+		t.Errorf("backend took %v, want traffic of a@example.com", b.reported)
+	}
+	left := s.outbox.all()
+	if len(left) != 1 || left[0].User.Email != "b@example.com" || left[0].Uplink != 2 {
+		t.Errorf("outbox = %v, want traffic of b@example.com only", left)
+	}
+}
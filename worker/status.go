@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coolray-dev/rayagent/metrics"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/utils"
+)
+
+// runtimeStatus is what workers know about the health of the agent
+// it is shared within worker package, like userPool
+type runtimeStatus struct {
+	lock        sync.RWMutex
+	startedAt   time.Time
+	lastSync    time.Time
+	lastError   string
+	activeUsers uint64
+	inbounds    uint64
+	components  map[string]*models.ComponentStatus // supervised workers
+	beats       map[string]time.Time               // when workers last finished a unit of work
+	syncApplied bool                               // services from backend were applied at least once
+}
+
+var agentStatus = &runtimeStatus{
+	startedAt:  time.Now(),
+	components: make(map[string]*models.ComponentStatus),
+	beats:      make(map[string]time.Time),
+}
+
+// synced records a successful sync with raydash
+func (s *runtimeStatus) synced() {
+	now := time.Now()
+	s.lock.Lock()
+	s.lastSync = now
+	s.lock.Unlock()
+	metrics.Synced(now)
+}
+
+// failed records the last error any worker ran into
+func (s *runtimeStatus) failed(err error) {
+	s.lock.Lock()
+	s.lastError = err.Error()
+	s.lock.Unlock()
+}
+
+// applied records what is currently applied to v2ray
+func (s *runtimeStatus) applied(users int, inbounds int) {
+	s.lock.Lock()
+	s.activeUsers = uint64(users)
+	s.inbounds = uint64(inbounds)
+	if !s.lastSync.IsZero() {
+		s.syncApplied = true
+	}
+	s.lock.Unlock()
+	metrics.Applied(users, inbounds)
+}
+
+// beat records component finished a unit of work, watchdog tells stalled workers by it
+func (s *runtimeStatus) beat(component string) {
+	now := time.Now()
+	s.lock.Lock()
+	s.beats[component] = now
+	s.lock.Unlock()
+}
+
+// lastBeat return when component last finished a unit of work, zero if never
+func (s *runtimeStatus) lastBeat(component string) time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.beats[component]
+}
+
+// readiness return when backend was last synced and whether its services were applied
+func (s *runtimeStatus) readiness() (time.Time, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastSync, s.syncApplied
+}
+
+// running records a supervised component is up
+func (s *runtimeStatus) running(component string) {
+	s.lock.Lock()
+	c, found := s.components[component]
+	if !found {
+		c = &models.ComponentStatus{Name: component}
+		s.components[component] = c
+	}
+	c.Healthy = true
+	s.lock.Unlock()
+}
+
+// panicked records a supervised component crashed and is waiting for restart
+func (s *runtimeStatus) panicked(component string, reason string) {
+	now := time.Now()
+	s.lock.Lock()
+	c, found := s.components[component]
+	if !found {
+		c = &models.ComponentStatus{Name: component}
+		s.components[component] = c
+	}
+	c.Healthy = false
+	c.Restarts++
+	c.LastPanic = reason
+	c.LastPanicAt = &now
+	s.lastError = component + " panicked: " + reason
+	s.lock.Unlock()
+}
+
+// healthy report whether every supervised component is up
+func (s *runtimeStatus) healthy() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, c := range s.components {
+		if !c.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeStatus return status known to workers, without v2ray stats
+func (s *runtimeStatus) nodeStatus() *models.NodeStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	status := &models.NodeStatus{
+		Version:     utils.Version,
+		Uptime:      uint64(time.Since(s.startedAt).Seconds()),
+		ActiveUsers: s.activeUsers,
+		Inbounds:    s.inbounds,
+		LastError:   s.lastError,
+	}
+	for _, c := range s.components {
+		status.Components = append(status.Components, *c)
+	}
+	sort.Slice(status.Components, func(i, j int) bool { return status.Components[i].Name < status.Components[j].Name })
+	if !s.lastSync.IsZero() {
+		lastSync := s.lastSync
+		status.LastSync = &lastSync
+	}
+	return status
+}
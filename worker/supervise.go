@@ -0,0 +1,63 @@
+package worker
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Restart backoff of supervised workers
+// kept short, a worker down is a worker not syncing users or traffic
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 10 * time.Second
+	stableRunTime     = time.Minute // a run longer than this resets backoff
+)
+
+// supervise run fn of worker until it returns
+// a panic is logged to log with its stack and fn is run again with backoff,
+// worker is reported unhealthy until then
+// waiting for restart is cut short once stop is closed, stop may be nil
+func supervise(worker string, log *logrus.Entry, stop <-chan struct{}, fn func()) {
+	backoff := minRestartBackoff
+	for {
+		agentStatus.running(worker)
+		start := time.Now()
+		v, stack := runRecovered(fn)
+		if stack == nil {
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"worker": worker,
+			"panic":  fmt.Sprint(v),
+			"stack":  string(stack),
+		}).Error("Worker Panicked")
+		if time.Since(start) > stableRunTime {
+			backoff = minRestartBackoff
+		}
+		agentStatus.panicked(worker, fmt.Sprint(v))
+
+		log.WithField("worker", worker).Warnf("Restarting Worker In %s", backoff)
+		select {
+		case <-stop:
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// runRecovered run fn and return what it panicked with and where, stack is nil if it did not
+// stack is taken in deferred func, where it still has the frames that panicked
+func runRecovered(fn func()) (v interface{}, stack []byte) {
+	defer func() {
+		if v = recover(); v != nil {
+			stack = debug.Stack()
+		}
+	}()
+	fn()
+	return
+}
@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coolray-dev/rayagent/audit"
+	"github.com/coolray-dev/rayagent/driver"
+	"github.com/coolray-dev/rayagent/metrics"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+	"github.com/coolray-dev/rayagent/utils"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// syncTimeout limit time spent talking to backend in a single sync
+const syncTimeout = time.Minute
+
+// SyncOnce fetch backend state, apply it to core, report traffic and return
+// core is reconciled from scratch, so inbounds rayagent manages are rebuilt
+func SyncOnce() error {
+	if modules.Config.GetString("v2ray.driver") == "embedded" {
+		return errors.New("sync --once needs an external core, embedded v2ray exits with rayagent")
+	}
+	nodeInfo.ID = modules.NodeID()
+	cycle := utils.NewCycle()
+
+	b, err := NewBackend()
+	if err != nil {
+		return err
+	}
+	if closer, ok := b.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if err := refreshUserPool(b); err != nil {
+		return fmt.Errorf("Error Getting Users: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	node, err := b.GetNode(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting NodeInfo: %w", err)
+	}
+	services, err := b.ListServices(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting Services: %w", err)
+	}
+	revision := revisionOf(b)
+
+	conn, err := modules.ConnectGRPC(modules.Config.GetString("v2ray.grpcaddr"), 10*time.Second, grpc.WithUnaryInterceptor(metrics.UnaryClientInterceptor))
+	if err != nil || conn == nil {
+		return fmt.Errorf("Error Connecting V2Ray: %v", err)
+	}
+	defer conn.Close()
+	d := driver.NewInstrumented(newDriver(conn))
+	if _, err := d.GetSysStats(); err != nil {
+		return fmt.Errorf("V2Ray Unreachable: %w", err)
+	}
+
+	// Apply
+	h := NewServiceHandler(nodeInfo.ID, node, d, nil)
+	h.Tag = modules.Config.GetString("v2ray.inbound")
+	if h.Audit, err = newAuditLogger(); err != nil {
+		return err
+	}
+	defer h.Audit.Close()
+	h.setCycle(cycle)
+	h.revision = revision
+	if node.HasMultiPort {
+		for i := range services {
+			_ = h.removeInbound(utils.ServiceTag(&services[i]), services[i].Email, audit.ReasonStartup) // left by last run, if any
+		}
+	} else if err := h.initializeSingleInbound(); err != nil {
+		return err
+	}
+	h.apply(services, "")
+	agentStatus.synced()
+
+	// Report traffic counted since last run
+	userPoolLock.RLock()
+	statsChannel := make(chan *models.Stats, len(userPool))
+	userPoolLock.RUnlock()
+	statsHandler := NewStatsHandler(d)
+	statsHandler.StatsChannel = statsChannel
+	statsHandler.getStats()
+	close(statsChannel)
+	statsSender := NewStatsSender(b)
+	statsSender.StatsChannel = statsChannel
+	statsSender.OutboxFile = outboxFile
+	statsSender.loadOutbox()
+	statsSender.syncStats()
+	if err := statsSender.flush(ctx); err != nil {
+		utils.Log.WithFields(logrus.Fields{
+			"cycle_id": cycle,
+			"pending":  statsSender.Pending(),
+		}).Warn("Traffic Kept In Outbox For Next Run")
+	}
+
+	if len(h.failures) != 0 {
+		return fmt.Errorf("%d of %d services failed to apply", len(h.failures), len(h.Services))
+	}
+	utils.Log.WithFields(logrus.Fields{
+		"cycle_id": cycle,
+		"services": len(h.Services),
+	}).Info("Sync Done")
+	return nil
+}
@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/coolray-dev/rayagent/driver"
+	"github.com/coolray-dev/rayagent/models"
+	"github.com/coolray-dev/rayagent/modules"
+)
+
+// validateTimeout limit time spent on each connectivity check
+const validateTimeout = 15 * time.Second
+
+// Validate check backend and core can be reached with current config
+// every check is written to w, false is returned if any failed
+func Validate(w io.Writer) bool {
+	ok := true
+	report := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] "+format+": %s\n", append(args, err)...)
+			return
+		}
+		fmt.Fprintf(w, "[ OK ] "+format+"\n", args...)
+	}
+
+	// Backend
+	var node *models.Node
+	var services []models.Service
+	b, err := NewBackend()
+	report(err, "backend %s", modules.Config.GetString("backend.type"))
+	if err == nil {
+		if closer, isCloser := b.(io.Closer); isCloser {
+			defer closer.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+		defer cancel()
+		node, err = b.GetNode(ctx)
+		report(err, "node settings")
+		users, err := b.ListUsers(ctx)
+		report(err, "users, %d found", len(users))
+		services, err = b.ListServices(ctx)
+		report(err, "services, %d found", len(services))
+	}
+
+	// Core
+	var d driver.Driver
+	switch {
+	case modules.Config.GetString("v2ray.driver") == "embedded":
+		d = &driver.Embedded{} // node settings can be checked without starting v2ray
+		report(nil, "embedded v2ray")
+	case modules.Config.GetBool("v2ray.supervise"):
+		binary := modules.Config.GetString("v2ray.binary")
+		_, err := exec.LookPath(binary)
+		report(err, "v2ray binary %s", binary)
+		d = newDriver(nil)
+	default:
+		addr := modules.Config.GetString("v2ray.grpcaddr")
+		conn, err := modules.ConnectGRPC(addr, validateTimeout)
+		if err == nil && conn == nil {
+			err = fmt.Errorf("timeout")
+		}
+		if err != nil {
+			report(err, "v2ray API at %s", addr)
+			break
+		}
+		defer conn.Close()
+		d = newDriver(conn)
+		_, err = d.GetSysStats()
+		report(err, "v2ray API at %s", addr)
+	}
+
+	// Node settings must turn into an inbound core accepts, or every service in multi inbound mode
+	if node != nil && d != nil && !node.HasMultiPort {
+		report(d.CheckNode(node), "node inbound for %s driver", modules.Config.GetString("v2ray.driver"))
+	}
+	if node != nil && d != nil && node.HasMultiPort {
+		for i := range services {
+			report(d.CheckService(&services[i]), "inbound of %s for %s driver", services[i].Email, modules.Config.GetString("v2ray.driver"))
+		}
+	}
+	return ok
+}
@@ -1,18 +1,20 @@
 package worker
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"net"
-	"net/http"
-	"strconv"
+	"context"
 	"sync"
-	"time"
 
+	"github.com/coolray-dev/rayagent/backend"
 	"github.com/coolray-dev/rayagent/models"
 	"github.com/coolray-dev/rayagent/modules"
 	"github.com/coolray-dev/rayagent/utils"
-	"github.com/sirupsen/logrus"
+)
+
+// Loggers of components, each may have its own level in log.levels
+var (
+	pollerLog  = utils.Logger("poller")
+	handlerLog = utils.Logger("handler")
+	statsLog   = utils.Logger("stats")
 )
 
 var userPool map[string]*models.User
@@ -20,8 +22,7 @@ var userPool map[string]*models.User
 var userPoolLock sync.RWMutex
 
 type typeNodeInfo struct {
-	Token string
-	ID    uint64
+	ID uint64
 }
 
 var nodeInfo typeNodeInfo
@@ -31,88 +32,63 @@ func init() {
 	userPool = make(map[string]*models.User)
 }
 
-func initUserPool() {
-
-	// Set retry times to 3 before exit program
-	retries := 3
-	var err error
-	var response *http.Response
-	for retries > 0 {
-
-		// Generate Request
-		endpoint := modules.Config.GetString("raydash.url") + "/nodes/" + strconv.Itoa(int(modules.Config.GetUint64("raydash.nodeID"))) + "/users"
-		var req *http.Request
-		req, err = http.NewRequest(http.MethodGet, endpoint, nil)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+"node."+modules.Config.GetString("raydash.token"))
-
-		// Call API
-		client := http.DefaultClient
-		response, err = client.Do(req)
-		if err != nil {
-			retries--
-			utils.Log.WithError(err).Error("Error Calling RayDash API")
-		} else if response.StatusCode != http.StatusOK {
-			retries--
-			utils.Log.WithField("StatusCode", response.StatusCode).Error("Error Calling RayDash API")
-		} else {
-			break
-		}
+// initUserPool fill userPool from backend
+// if backend cannot be reached, the last snapshot is used instead and returned
+func initUserPool(b backend.Backend) *snapshot {
+	err := refreshUserPool(b)
+	if err == nil {
+		return nil
 	}
+	utils.Log.WithError(err).Error("Error Getting Users")
 
-	// Exit rayagent if still cannot retrieve users
-	if err != nil || response.StatusCode != http.StatusOK {
-		utils.Log.Fatal("Error Calling RayDash API")
+	// Fall back to last known good state
+	snap, snapErr := loadSnapshot()
+	if snapErr != nil {
+		utils.Log.WithError(snapErr).Fatal("Error Loading Snapshot, Cannot Start Without Backend")
 	}
-
-	// Read and bind response
-	body, _ := ioutil.ReadAll(response.Body)
-	type Response struct {
-		Users []models.User `json:"users" binding:"required"`
+	userPoolLock.Lock()
+	for i := range snap.Users {
+		userPool[snap.Users[i].Email] = &snap.Users[i]
 	}
-	var r Response
-	err = json.Unmarshal(body, &r)
+	userPoolLock.Unlock()
+	utils.Log.WithField("savedAt", snap.SavedAt).Warn("Backend Unreachable, Starting From Snapshot")
+	return snap
+}
+
+// refreshUserPool retrieve users from backend and update userPool
+// traffic counted locally is kept for users already in the pool,
+// users backend no longer returns are removed
+func refreshUserPool(b backend.Backend) error {
+
+	// Retries are handled by backend
+	users, err := b.ListUsers(context.Background())
 	if err != nil {
-		utils.Log.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Panic("Error Parsing RayDash API Response")
+		return err
 	}
 
-	// Fill userPool
-	for _, u := range r.Users {
+	// Fill userPool only after every page is in
+	userPoolLock.Lock()
+	returned := make(map[string]bool, len(users))
+	for i := range users {
+		returned[users[i].Email] = true
 
 		// Validate user before adding
-		if err := modules.Validator.Struct(&u); err != nil {
-			utils.Log.WithField("username", u.Username).WithError(err).Warn("User Validation Failed")
+		if err := modules.Validator.Struct(&users[i]); err != nil {
+			utils.Log.WithField("username", users[i].Username).WithError(err).Warn("User Validation Failed")
 			continue
 		}
 
-		userPool[u.Email] = &u
+		if u, found := userPool[users[i].Email]; found && u.CurrentTraffic > users[i].CurrentTraffic {
+			users[i].CurrentTraffic = u.CurrentTraffic
+		}
+		userPool[users[i].Email] = &users[i]
 	}
-	return
-}
-
-// Network Const
-const (
-	MaxIdleConns        int = 10
-	MaxIdleConnsPerHost int = 10
-	IdleConnTimeout     int = 90
-)
-
-// createHTTPClient for connection re-use
-func createHTTPClient() *http.Client {
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			MaxIdleConns:        MaxIdleConns,
-			MaxIdleConnsPerHost: MaxIdleConnsPerHost,
-			IdleConnTimeout:     time.Duration(IdleConnTimeout) * time.Second,
-		},
-		Timeout: 30 * time.Second,
+	// Pool is shared with every worker, so it is changed in place
+	for email := range userPool {
+		if !returned[email] {
+			delete(userPool, email)
+		}
 	}
-	return client
+	userPoolLock.Unlock()
+	return nil
 }
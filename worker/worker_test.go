@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/coolray-dev/rayagent/models"
+)
+
+func TestRefreshUserPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    []models.User
+		users   []models.User
+		err     error
+		current map[string]uint64 // CurrentTraffic of every user left in pool
+	}{
+		{
+			name:    "users are added",
+			users:   []models.User{testUser("a@example.com", 100, 1), testUser("b@example.com", 100, 2)},
+			current: map[string]uint64{"a@example.com": 1, "b@example.com": 2},
+		},
+		{
+			name:    "invalid users are skipped",
+			users:   []models.User{testUser("a@example.com", 100, 1), {Email: "b@example.com", MaxTraffic: 100}},
+			current: map[string]uint64{"a@example.com": 1},
+		},
+		{
+			name:    "traffic counted locally is kept until backend catches up",
+			pool:    []models.User{testUser("a@example.com", 100, 50), testUser("b@example.com", 100, 5)},
+			users:   []models.User{testUser("a@example.com", 100, 40), testUser("b@example.com", 100, 10)},
+			current: map[string]uint64{"a@example.com": 50, "b@example.com": 10},
+		},
+		{
+			name:    "users backend dropped are evicted",
+			pool:    []models.User{testUser("a@example.com", 100, 1), testUser("b@example.com", 100, 2)},
+			users:   []models.User{testUser("a@example.com", 100, 1)},
+			current: map[string]uint64{"a@example.com": 1},
+		},
+		{
+			name:    "pool is kept if backend fails",
+			pool:    []models.User{testUser("a@example.com", 100, 1)},
+			err:     errors.New("backend unavailable"),
+			current: map[string]uint64{"a@example.com": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUserPool(tt.pool...)
+			b := &fakeBackend{users: tt.users, usersErr: tt.err}
+
+			if err := refreshUserPool(b); err != tt.err {
+				t.Errorf("refreshUserPool() error = %v, want %v", err, tt.err)
+			}
+
+			current := make(map[string]uint64)
+			for email, u := range userPool {
+				current[email] = u.CurrentTraffic
+			}
+			if !reflect.DeepEqual(current, tt.current) {
+				t.Errorf("pool = %v, want %v", current, tt.current)
+			}
+		})
+	}
+}